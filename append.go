@@ -0,0 +1,168 @@
+package keyval
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Appender is implemented by stores, which can write into a value
+// without rewriting it. Both create missing values, but WriteAt only
+// at offset 0, as writing past the end of a value is invalid.
+type Appender interface {
+	Append(key []byte, reader io.Reader) error
+	WriteAt(key []byte, offset int64, reader io.Reader) error
+}
+
+// AppenderContext is the context aware counterpart of Appender.
+type AppenderContext interface {
+	AppendContext(ctx context.Context, key []byte, reader io.Reader) error
+	WriteAtContext(ctx context.Context, key []byte, offset int64, reader io.Reader) error
+}
+
+// Append writes reader to the end of the value of key. Stores not
+// implementing Appender have the value read and set again, see rewrite.
+func Append(store KeyValStore, key []byte, reader io.Reader) error {
+	return AppendContext(context.Background(), store, key, reader)
+}
+
+// AppendContext is Append, failing with the context error as soon as
+// ctx is done.
+func AppendContext(ctx context.Context, store KeyValStore, key []byte, reader io.Reader) error {
+	if a, ok := store.(AppenderContext); ok {
+		return a.AppendContext(ctx, key, reader)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	reader = NewContextReader(ctx, reader)
+	if a, ok := store.(Appender); ok {
+		return a.Append(key, reader)
+	}
+
+	stat, err := currentStat(ctx, store, key)
+	if err != nil {
+		return err
+	}
+
+	kv := WithContext(store)
+	current, err := kv.GetContext(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return kv.SetContext(ctx, key, reader)
+	} else if err != nil {
+		return err
+	}
+	defer current.Close()
+
+	return rewrite(ctx, store, key, stat, io.MultiReader(current, reader))
+}
+
+// WriteAt writes reader into the value of key, starting at offset.
+// Stores not implementing Appender have the value read and set again,
+// see rewrite.
+func WriteAt(store KeyValStore, key []byte, offset int64, reader io.Reader) error {
+	return WriteAtContext(context.Background(), store, key, offset, reader)
+}
+
+// WriteAtContext is WriteAt, failing with the context error as soon as
+// ctx is done.
+func WriteAtContext(ctx context.Context, store KeyValStore, key []byte, offset int64, reader io.Reader) error {
+	if offset < 0 {
+		return ErrInvalidRange
+	}
+	if a, ok := store.(AppenderContext); ok {
+		return a.WriteAtContext(ctx, key, offset, reader)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	reader = NewContextReader(ctx, reader)
+	if a, ok := store.(Appender); ok {
+		return a.WriteAt(key, offset, reader)
+	}
+
+	stat, err := currentStat(ctx, store, key)
+	if err != nil {
+		return err
+	}
+
+	kv := WithContext(store)
+	current, err := kv.GetBytesContext(ctx, key)
+	missing := errors.Is(err, ErrNotFound)
+	if err != nil && !missing {
+		return err
+	}
+
+	bs, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	value, err := Splice(current, offset, bs)
+	if err != nil {
+		return err
+	}
+
+	if missing {
+		return kv.SetContext(ctx, key, bytes.NewReader(value))
+	}
+	return rewrite(ctx, store, key, stat, bytes.NewReader(value))
+}
+
+// currentStat returns the stat of key, or nil if it is missing or store
+// keeps no metadata.
+func currentStat(ctx context.Context, store KeyValStore, key []byte) (Stat, error) {
+	meta, ok := store.(KeyValMetaStore)
+	if !ok {
+		return nil, nil
+	}
+	stat, err := WithMetaContext(meta).StatContext(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return stat, err
+}
+
+// rewrite sets the new value of key, read and modified by the fallbacks
+// of Append and WriteAt. This is not atomic, as the value is read without
+// holding a lock. Stores implementing MetadataStore keep the metadata and
+// expiry of stat, and fail with ErrConflict if the value has changed since
+// it was read, or ErrNotFound if it has expired. On other stores the
+// metadata and expiry are cleared, and concurrent changes are lost.
+func rewrite(ctx context.Context, store KeyValStore, key []byte, stat Stat, reader io.Reader) error {
+	ms, ok := store.(MetadataStore)
+	if !ok || stat == nil {
+		return WithContext(store).SetContext(ctx, key, reader)
+	}
+
+	options := SetOptions{Metadata: stat.Metadata()}
+	if expires := stat.Expires(); !expires.IsZero() {
+		// An expired value is rejected by the condition
+		if ttl := time.Until(expires); ttl > 0 {
+			options.TTL = ttl
+		}
+	}
+	if hash := stat.Hash(); len(hash) > 0 {
+		options.Condition = IfMatch(hash)
+	}
+
+	return ms.SetWithOptions(ctx, key, reader, options)
+}
+
+// Splice returns value with bs written at offset, growing it if needed.
+func Splice(value []byte, offset int64, bs []byte) ([]byte, error) {
+	if offset < 0 || offset > int64(len(value)) {
+		return nil, ErrInvalidRange
+	}
+	size := offset + int64(len(bs))
+	if size < int64(len(value)) {
+		size = int64(len(value))
+	}
+	out := make([]byte, size)
+	copy(out, value)
+	copy(out[offset:], bs)
+	return out, nil
+}
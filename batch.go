@@ -0,0 +1,78 @@
+package keyval
+
+type BatchOpType int
+
+const (
+	BatchPut BatchOpType = iota
+	BatchDelete
+)
+
+type BatchOp struct {
+	Type  BatchOpType
+	Key   []byte
+	Value []byte
+}
+
+// Batch collects put and delete operations, which are applied by Commit.
+// Operations are applied in the order they were added.
+type Batch interface {
+	Put(key []byte, value []byte)
+	Delete(key []byte)
+	Len() int
+	Commit() error
+}
+
+// Batcher is implemented by stores with native batch support.
+type Batcher interface {
+	Batch() Batch
+}
+
+// NewBatch returns a batch for store. Stores not implementing Batcher
+// get a generic batch, which applies operations one at a time and stops
+// at the first error.
+func NewBatch(store KeyValStore) Batch {
+	if b, ok := store.(Batcher); ok {
+		return b.Batch()
+	}
+	return &batch{store: store}
+}
+
+// BatchOps is a helper for Batch implementations, collecting operations.
+type BatchOps struct {
+	Ops []BatchOp
+}
+
+func (b *BatchOps) Put(key []byte, value []byte) {
+	b.Ops = append(b.Ops, BatchOp{BatchPut, key, value})
+}
+
+func (b *BatchOps) Delete(key []byte) {
+	b.Ops = append(b.Ops, BatchOp{BatchDelete, key, nil})
+}
+
+func (b *BatchOps) Len() int {
+	return len(b.Ops)
+}
+
+type batch struct {
+	BatchOps
+	store KeyValStore
+}
+
+func (b *batch) Commit() error {
+	ops := b.Ops
+	b.Ops = nil
+	for _, op := range ops {
+		var err error
+		switch op.Type {
+		case BatchPut:
+			err = b.store.SetBytes(op.Key, op.Value)
+		case BatchDelete:
+			_, err = b.store.Remove(op.Key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
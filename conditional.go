@@ -0,0 +1,42 @@
+package keyval
+
+import (
+	"bytes"
+	"io"
+)
+
+// ConditionalStore is implemented by stores supporting optimistic
+// concurrency. Values are matched on their content hash, as reported
+// by Stat.Hash. A nil match accepts any existing value.
+//
+// SetIfNotExists fails with ErrExists, if the key is present. SetIfMatch
+// and DeleteIfMatch fail with ErrNotFound if the key is missing, and with
+// ErrConflict if the current value does not match.
+type ConditionalStore interface {
+	SetIfNotExists(key []byte, reader io.Reader) error
+	SetIfMatch(key []byte, reader io.Reader, match []byte) error
+	DeleteIfMatch(key []byte, match []byte) error
+}
+
+// Condition is checked against the current value of a key, while the
+// store holds its write lock. current is nil if the key does not exist.
+type Condition func(current Stat) error
+
+func IfNotExists(current Stat) error {
+	if current != nil {
+		return ErrExists
+	}
+	return nil
+}
+
+func IfMatch(match []byte) Condition {
+	return func(current Stat) error {
+		if current == nil {
+			return ErrNotFound
+		}
+		if match != nil && !bytes.Equal(current.Hash(), match) {
+			return ErrConflict
+		}
+		return nil
+	}
+}
@@ -0,0 +1,135 @@
+package keyval
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+)
+
+type KeyValStoreContext interface {
+	SetContext(ctx context.Context, key []byte, reader io.Reader) error
+	SetBytesContext(ctx context.Context, key []byte, bytes []byte) error
+	HasContext(ctx context.Context, key []byte) (bool, error)
+	RemoveContext(ctx context.Context, key []byte) (bool, error)
+	GetContext(ctx context.Context, key []byte) (io.ReadCloser, error)
+	GetBytesContext(ctx context.Context, key []byte) ([]byte, error)
+}
+
+type KeyValMetaStoreContext interface {
+	StatContext(ctx context.Context, key []byte) (Stat, error)
+	ListContext(ctx context.Context, prefix []byte, fn func(key []byte, meta Stat) error) error
+}
+
+// WithContext returns a context aware view of store. Stores implementing
+// KeyValStoreContext natively are returned as is, all others are wrapped
+// so that cancellation is checked before each call and while streaming.
+func WithContext(store KeyValStore) KeyValStoreContext {
+	if s, ok := store.(KeyValStoreContext); ok {
+		return s
+	}
+	return &contextStore{store}
+}
+
+// WithMetaContext is the KeyValMetaStore counterpart of WithContext.
+func WithMetaContext(store KeyValMetaStore) KeyValMetaStoreContext {
+	if s, ok := store.(KeyValMetaStoreContext); ok {
+		return s
+	}
+	return &contextMetaStore{store}
+}
+
+type contextStore struct {
+	store KeyValStore
+}
+
+func (c *contextStore) SetContext(ctx context.Context, key []byte, reader io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.store.Set(key, NewContextReader(ctx, reader))
+}
+
+func (c *contextStore) SetBytesContext(ctx context.Context, key []byte, bs []byte) error {
+	return c.SetContext(ctx, key, bytes.NewReader(bs))
+}
+
+func (c *contextStore) HasContext(ctx context.Context, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return c.store.Has(key)
+}
+
+func (c *contextStore) RemoveContext(ctx context.Context, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return c.store.Remove(key)
+}
+
+func (c *contextStore) GetContext(ctx context.Context, key []byte) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	reader, err := c.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return &contextReadCloser{NewContextReader(ctx, reader), reader}, nil
+}
+
+func (c *contextStore) GetBytesContext(ctx context.Context, key []byte) ([]byte, error) {
+	reader, err := c.GetContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+type contextMetaStore struct {
+	store KeyValMetaStore
+}
+
+func (c *contextMetaStore) StatContext(ctx context.Context, key []byte) (Stat, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.store.Stat(key)
+}
+
+func (c *contextMetaStore) ListContext(ctx context.Context, prefix []byte, fn func(key []byte, meta Stat) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.store.List(prefix, func(key []byte, meta Stat) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(key, meta)
+	})
+}
+
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
+type contextReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// NewContextReader returns a reader which fails with the context error,
+// as soon as ctx is done.
+func NewContextReader(ctx context.Context, reader io.Reader) io.Reader {
+	return &contextReader{ctx, reader}
+}
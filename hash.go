@@ -0,0 +1,43 @@
+package keyval
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
+)
+
+const DefaultHashAlgorithm = "sha256"
+
+var _hashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake2b": func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	},
+	"xxhash": func() hash.Hash {
+		return xxhash.New()
+	},
+}
+
+// NewHash returns a hash for the named algorithm. An empty name
+// selects DefaultHashAlgorithm.
+func NewHash(algorithm string) (hash.Hash, error) {
+	if algorithm == "" {
+		algorithm = DefaultHashAlgorithm
+	}
+	if fn, ok := _hashes[algorithm]; ok {
+		return fn(), nil
+	}
+	return nil, fmt.Errorf("hash: unknown algorithm '%s'", algorithm)
+}
+
+// ValidHash reports whether algorithm is supported by NewHash.
+func ValidHash(algorithm string) bool {
+	_, err := NewHash(algorithm)
+	return err == nil
+}
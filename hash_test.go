@@ -0,0 +1,50 @@
+package keyval
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestNewHash(t *testing.T) {
+
+	tests := []struct {
+		algorithm string
+		expected  string
+	}{
+		{"", "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e"},
+		{"sha256", "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e"},
+		{"sha512", "2c74fd17edafd80e8447b0d46741ee243b7eb74dd2149a0ab1b9246fb30382f27e853d8585719e0e67cbda0daa8f51671064615d645ae27acb15bfb1447f459b"},
+		{"blake2b", "1dc01772ee0171f5f614c673e3c7fa1107a8cf727bdf5a6dadb379e93c0d1d00"},
+		{"xxhash", "6334d20719245bc2"},
+	}
+
+	for _, test := range tests {
+		h, err := NewHash(test.algorithm)
+		if err != nil {
+			t.Fatalf("%s: %s", test.algorithm, err)
+		}
+		h.Write([]byte("Hello World"))
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != test.expected {
+			t.Fatalf("%s: expected %s, got %s", test.algorithm, test.expected, sum)
+		}
+	}
+
+	if _, err := NewHash("md5"); err == nil {
+		t.Fatal("expected unknown algorithm to be rejected")
+	}
+}
+
+func TestValidHash(t *testing.T) {
+
+	for _, algorithm := range []string{"", "sha256", "sha512", "blake2b", "xxhash"} {
+		if !ValidHash(algorithm) {
+			t.Fatalf("expected %q to be valid", algorithm)
+		}
+	}
+
+	for _, algorithm := range []string{"md5", "SHA256", "sha1"} {
+		if ValidHash(algorithm) {
+			t.Fatalf("expected %q to be invalid", algorithm)
+		}
+	}
+}
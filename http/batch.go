@@ -0,0 +1,48 @@
+package http
+
+import (
+	"encoding/json"
+
+	"github.com/kildevaeld/keyval"
+	"github.com/kildevaeld/strong"
+	"github.com/kildevaeld/valse"
+)
+
+// batchRequest is the body of POST /batch. Values are base64 encoded.
+type batchRequest struct {
+	Ops []struct {
+		Op    string `json:"op"`
+		Key   string `json:"key"`
+		Value []byte `json:"value"`
+	} `json:"ops"`
+}
+
+func (s *HttpServer) handleBatch(ctx *valse.Context) error {
+	var req batchRequest
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		return strong.NewHTTPError(strong.StatusBadRequest)
+	}
+
+	batch := keyval.NewBatch(s.store)
+	for _, op := range req.Ops {
+		if op.Key == "" {
+			return strong.NewHTTPError(strong.StatusBadRequest)
+		}
+		switch op.Op {
+		case "put":
+			batch.Put([]byte(op.Key), op.Value)
+		case "delete":
+			batch.Delete([]byte(op.Key))
+		default:
+			return strong.NewHTTPError(strong.StatusBadRequest)
+		}
+	}
+
+	if err := batch.Commit(); err != nil {
+		return httpError(err)
+	}
+
+	ctx.SetStatusCode(strong.StatusNoContent)
+
+	return nil
+}
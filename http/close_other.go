@@ -0,0 +1,11 @@
+//go:build !unix
+
+package http
+
+import "net"
+
+// onClose is not supported on this platform. Requests are only canceled
+// by the server timeout.
+func onClose(conn net.Conn, fn func()) (stop func()) {
+	return func() {}
+}
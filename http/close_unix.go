@@ -0,0 +1,54 @@
+//go:build unix
+
+package http
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// onClose calls fn if the client closes conn, while a request is being
+// handled. The connection is watched by peeking at it, so no data meant
+// for the next request is consumed. stop must be called before the
+// handler returns, as the connection is read again afterwards.
+func onClose(conn net.Conn, fn func()) (stop func()) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return func() {}
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		var (
+			buf    [1]byte
+			closed bool
+		)
+		// Returning false waits until the connection is readable, or
+		// the read deadline set by stop has passed
+		err := raw.Read(func(fd uintptr) bool {
+			n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK)
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				return false
+			}
+			// Pending data is a pipelined request, not a disconnect
+			closed = n == 0 || err != nil
+			return true
+		})
+		if err == nil && closed {
+			fn()
+		}
+	}()
+
+	return func() {
+		conn.SetReadDeadline(time.Now())
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	}
+}
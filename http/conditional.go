@@ -0,0 +1,298 @@
+package http
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/kildevaeld/keyval"
+	"github.com/kildevaeld/strong"
+	"github.com/kildevaeld/valse"
+)
+
+const (
+	HeaderIfMatch     = "If-Match"
+	HeaderIfNoneMatch = "If-None-Match"
+)
+
+func isConditional(ctx *valse.Context) bool {
+	return len(ctx.Request.Header.Peek(HeaderIfMatch)) > 0 ||
+		len(ctx.Request.Header.Peek(HeaderIfNoneMatch)) > 0
+}
+
+var errInvalidETag = errors.New("invalid entity tag")
+
+// parseETags parses the list of entity tags of an If-Match or
+// If-None-Match header (RFC 9110, section 8.8.3). The tags are returned
+// without quotes, weak tags keep their "W/" prefix. The wildcard "*"
+// yields a nil list, matching any value.
+func parseETags(value []byte) ([]string, error) {
+	value = bytes.TrimSpace(value)
+	if bytes.Equal(value, []byte("*")) {
+		return nil, nil
+	}
+
+	var tags []string
+	for {
+		// Empty list elements are allowed
+		value = bytes.TrimLeft(value, " \t,")
+		if len(value) == 0 {
+			break
+		}
+
+		weak := bytes.HasPrefix(value, []byte("W/"))
+		if weak {
+			value = value[2:]
+		}
+		if len(value) == 0 || value[0] != '"' {
+			return nil, errInvalidETag
+		}
+		end := bytes.IndexByte(value[1:], '"')
+		if end < 0 {
+			return nil, errInvalidETag
+		}
+
+		tag := string(value[1 : end+1])
+		if weak {
+			tag = "W/" + tag
+		}
+		tags = append(tags, tag)
+
+		value = bytes.TrimLeft(value[end+2:], " \t")
+		if len(value) > 0 && value[0] != ',' {
+			return nil, errInvalidETag
+		}
+	}
+
+	if len(tags) == 0 {
+		return nil, errInvalidETag
+	}
+	return tags, nil
+}
+
+// matchETags reports whether one of tags is the entity tag of hash. Weak
+// tags only match with the weak comparison used by If-None-Match.
+func matchETags(tags []string, hash []byte, weak bool) bool {
+	if len(hash) == 0 {
+		return false
+	}
+	current := hex.EncodeToString(hash)
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == current {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether If-None-Match matches the value of a GET
+// or HEAD request, which uses weak comparison. A malformed header is
+// ignored, and the value served.
+func notModified(ctx *valse.Context, stat keyval.Stat) bool {
+	header := ctx.Request.Header.Peek(HeaderIfNoneMatch)
+	if len(header) == 0 {
+		return false
+	}
+	tags, err := parseETags(header)
+	if err != nil {
+		return false
+	}
+	return tags == nil || matchETags(tags, stat.Hash(), true)
+}
+
+// setNotModified responds with 304 Not Modified, keeping the ETag
+func setNotModified(ctx *valse.Context, stat keyval.Stat) {
+	if hash := stat.Hash(); len(hash) > 0 {
+		ctx.Response.Header.Set("ETag", etag(hash))
+	}
+	ctx.SetStatusCode(strong.StatusNotModified)
+}
+
+// ifMatch accepts existing values matching one of tags, or any existing
+// value for a nil list.
+func ifMatch(tags []string) keyval.Condition {
+	return func(current keyval.Stat) error {
+		if current == nil {
+			return keyval.ErrNotFound
+		}
+		if tags != nil && !matchETags(tags, current.Hash(), false) {
+			return keyval.ErrConflict
+		}
+		return nil
+	}
+}
+
+// ifNoneMatch accepts missing values and values matching none of tags.
+func ifNoneMatch(tags []string) keyval.Condition {
+	if tags == nil {
+		return keyval.IfNotExists
+	}
+	return func(current keyval.Stat) error {
+		if current != nil && matchETags(tags, current.Hash(), true) {
+			return keyval.ErrExists
+		}
+		return nil
+	}
+}
+
+// strongHash returns the hash a ConditionalStore matches for tags, which
+// is nil for the wildcard. ok is false if tags are not a single strong tag
+// of a hash.
+func strongHash(tags []string) (hash []byte, ok bool) {
+	if tags == nil {
+		return nil, true
+	}
+	if len(tags) != 1 || strings.HasPrefix(tags[0], "W/") {
+		return nil, false
+	}
+	hash, err := hex.DecodeString(tags[0])
+	return hash, err == nil
+}
+
+// preconditionError maps failed conditions onto 412 Precondition Failed
+func preconditionError(err error) error {
+	if errors.Is(err, keyval.ErrExists) || errors.Is(err, keyval.ErrConflict) || errors.Is(err, keyval.ErrNotFound) {
+		return strong.NewHTTPError(strong.StatusPreconditionFailed)
+	}
+	return httpError(err)
+}
+
+// parseCondition returns the condition of a conditional write. If both
+// headers are given, the value must pass If-Match and If-None-Match.
+func parseCondition(ctx *valse.Context) (keyval.Condition, error) {
+	var conds []keyval.Condition
+	if match := ctx.Request.Header.Peek(HeaderIfMatch); len(match) > 0 {
+		tags, err := parseETags(match)
+		if err != nil {
+			return nil, strong.NewHTTPError(strong.StatusBadRequest)
+		}
+		conds = append(conds, ifMatch(tags))
+	}
+	if noneMatch := ctx.Request.Header.Peek(HeaderIfNoneMatch); len(noneMatch) > 0 {
+		tags, err := parseETags(noneMatch)
+		if err != nil {
+			return nil, strong.NewHTTPError(strong.StatusBadRequest)
+		}
+		conds = append(conds, ifNoneMatch(tags))
+	}
+
+	if len(conds) == 1 {
+		return conds[0], nil
+	}
+	return func(current keyval.Stat) error {
+		for _, cond := range conds {
+			if err := cond(current); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+func (s *HttpServer) setConditional(ctx *valse.Context, key []byte, reader io.Reader) error {
+
+	store, ok := s.store.(keyval.ConditionalStore)
+	if !ok {
+		return strong.NewHTTPError(strong.StatusNotImplemented)
+	}
+
+	c, cancel := s.context(ctx)
+	defer cancel()
+
+	if err := c.Err(); err != nil {
+		return httpError(err)
+	}
+	reader = keyval.NewContextReader(c, reader)
+
+	var err error
+
+	// ConditionalStore only checks for existence, or a single hash
+	if noneMatch := ctx.Request.Header.Peek(HeaderIfNoneMatch); len(noneMatch) > 0 {
+		tags, e := parseETags(noneMatch)
+		if e != nil {
+			return strong.NewHTTPError(strong.StatusBadRequest)
+		}
+		if tags != nil || len(ctx.Request.Header.Peek(HeaderIfMatch)) > 0 {
+			return strong.NewHTTPError(strong.StatusNotImplemented)
+		}
+		err = store.SetIfNotExists(key, reader)
+	} else {
+		tags, e := parseETags(ctx.Request.Header.Peek(HeaderIfMatch))
+		if e != nil {
+			return strong.NewHTTPError(strong.StatusBadRequest)
+		}
+		match, ok := strongHash(tags)
+		if !ok {
+			return strong.NewHTTPError(strong.StatusNotImplemented)
+		}
+		err = store.SetIfMatch(key, reader, match)
+	}
+
+	if err != nil {
+		return preconditionError(err)
+	}
+
+	return nil
+}
+
+func (s *HttpServer) removeConditional(ctx *valse.Context, key []byte) error {
+
+	store, ok := s.store.(keyval.ConditionalStore)
+	if !ok {
+		return strong.NewHTTPError(strong.StatusNotImplemented)
+	}
+
+	// DeleteIfMatch cannot check that a value does not match
+	if len(ctx.Request.Header.Peek(HeaderIfNoneMatch)) > 0 {
+		return strong.NewHTTPError(strong.StatusNotImplemented)
+	}
+
+	tags, err := parseETags(ctx.Request.Header.Peek(HeaderIfMatch))
+	if err != nil {
+		return strong.NewHTTPError(strong.StatusBadRequest)
+	}
+
+	c, cancel := s.context(ctx)
+	defer cancel()
+
+	if err := c.Err(); err != nil {
+		return httpError(err)
+	}
+
+	if tags == nil {
+		if err := store.DeleteIfMatch(key, nil); err != nil {
+			return preconditionError(err)
+		}
+		ctx.SetStatusCode(strong.StatusNoContent)
+		return nil
+	}
+
+	// Each tag is tried in turn. Deleting is atomic for every tag, so the
+	// value is only removed if it matched one of them when it was removed.
+	err = keyval.ErrConflict
+	for _, tag := range tags {
+		match, ok := strongHash([]string{tag})
+		if !ok {
+			// Weak and foreign tags never match strongly
+			continue
+		}
+		if err = store.DeleteIfMatch(key, match); !errors.Is(err, keyval.ErrConflict) {
+			break
+		}
+	}
+	if err != nil {
+		return preconditionError(err)
+	}
+
+	ctx.SetStatusCode(strong.StatusNoContent)
+
+	return nil
+}
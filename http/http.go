@@ -2,13 +2,16 @@ package http
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strconv"
+	"time"
 
 	"github.com/aarzilli/golua/lua"
 	jwt "github.com/dgrijalva/jwt-go"
-	"github.com/kildevaeld/bproxy/mime"
 	"github.com/kildevaeld/goluaext"
 	"github.com/kildevaeld/keyval"
 	"github.com/kildevaeld/strong"
@@ -19,15 +22,23 @@ import (
 
 var FileField = "file"
 
+const (
+	HeaderTTL     = "X-KV-TTL"
+	HeaderExpires = "X-KV-Expires"
+)
+
 type ServerOptions struct {
 	ScriptPath string
 	WorkQueue  int
 	MaxAge     int
+	Timeout    time.Duration
 }
 
 type HttpServer struct {
 	v       *valse.Server
-	kv      keyval.KeyValStore
+	store   keyval.KeyValStore
+	kv      keyval.KeyValStoreContext
+	meta    keyval.KeyValMetaStoreContext
 	options ServerOptions
 	l       *luam.LuaValse
 }
@@ -63,7 +74,7 @@ func (s *HttpServer) initLua() *lua.State {
 			},
 		},
 		"set": func(key, val string) {
-			s.kv.SetBytes([]byte(key), []byte(val))
+			s.kv.SetBytesContext(context.Background(), []byte(key), []byte(val))
 		},
 	})
 	L.SetGlobal("kv")
@@ -84,6 +95,11 @@ func (s *HttpServer) init(options ServerOptions) error {
 	s.v.Get("/store/*path", s.handleGet)
 	s.v.Head("/store/*path", s.handleCheck)
 	s.v.Post("/store/*path", s.handleSet)
+	s.v.Patch("/store/*path", s.handlePatch)
+	s.v.Delete("/store/*path", s.handleRemove)
+	s.v.Post("/batch", s.handleBatch)
+	s.v.Get("/list", s.handleList)
+	s.v.Get("/watch", s.handleWatch)
 
 	/*if kv, ok := s.kv.(keyval.KeyValMetaStore); ok {
 		s.v.Get("/store/*p")
@@ -92,6 +108,25 @@ func (s *HttpServer) init(options ServerOptions) error {
 	return nil
 }
 
+// context returns the context of a request. It is canceled when the
+// client disconnects, the server shuts down or the timeout expires.
+func (s *HttpServer) context(ctx *valse.Context) (context.Context, context.CancelFunc) {
+	var (
+		c      context.Context = ctx
+		cancel context.CancelFunc
+	)
+	if s.options.Timeout > 0 {
+		c, cancel = context.WithTimeout(c, s.options.Timeout)
+	} else {
+		c, cancel = context.WithCancel(c)
+	}
+	stop := onClose(ctx.Conn(), cancel)
+	return c, func() {
+		stop()
+		cancel()
+	}
+}
+
 func (s *HttpServer) handleCheck(ctx *valse.Context) error {
 
 	name := ctx.UserValue("path").(string)
@@ -99,23 +134,52 @@ func (s *HttpServer) handleCheck(ctx *valse.Context) error {
 		return strong.NewHTTPError(strong.StatusBadRequest)
 	}
 
-	if !s.kv.Has([]byte(name[1:])) {
-		ctx.SetStatusCode(strong.StatusOK)
-	} else {
-		ctx.SetStatusCode(strong.StatusNotFound)
+	c, cancel := s.context(ctx)
+	defer cancel()
+
+	has, err := s.kv.HasContext(c, []byte(name[1:]))
+	if err != nil {
+		return httpError(err)
+	} else if !has {
+		return strong.NewHTTPError(strong.StatusNotFound)
 	}
 
-	if i, ok := s.kv.(keyval.KeyValMetaStore); ok {
-		stat, err := i.Stat([]byte(name[1:]))
+	ctx.SetStatusCode(strong.StatusOK)
+
+	if s.meta != nil {
+		stat, err := s.meta.StatContext(c, []byte(name[1:]))
 		if err != nil {
-			return err
+			return httpError(err)
+		}
+		if notModified(ctx, stat) {
+			setNotModified(ctx, stat)
+			return nil
 		}
-		ctx.Response.Header.SetContentLength(int(stat.Size()))
+		setStatHeaders(ctx, stat)
 	}
 
 	return nil
 }
 
+func setStatHeaders(ctx *valse.Context, stat keyval.Stat) {
+	ctx.Response.Header.SetContentLength(int(stat.Size()))
+	if !stat.Mtime().IsZero() {
+		ctx.Response.Header.Set("Last-Modified", stat.Mtime().UTC().Format(time.RFC1123))
+	}
+	if hash := stat.Hash(); len(hash) > 0 {
+		ctx.Response.Header.Set("ETag", etag(hash))
+	}
+	if expires := stat.Expires(); !expires.IsZero() {
+		ctx.Response.Header.Set(HeaderExpires, expires.UTC().Format(time.RFC1123))
+	}
+	ctx.Response.Header.Set(HeaderAcceptRanges, "bytes")
+	setMetadataHeaders(ctx, stat.Metadata())
+}
+
+func etag(hash []byte) string {
+	return fmt.Sprintf("\"%x\"", hash)
+}
+
 func (s *HttpServer) handleSet(ctx *valse.Context) error {
 
 	name := ctx.UserValue("path").(string)
@@ -123,6 +187,7 @@ func (s *HttpServer) handleSet(ctx *valse.Context) error {
 		return strong.NewHTTPError(strong.StatusBadRequest)
 	}
 	var reader io.ReadCloser
+	meta := keyval.Metadata{}
 	if bytes.HasPrefix(ctx.Request.Header.ContentType(), []byte("multipart/form-data")) {
 		file, err := ctx.FormFile(FileField)
 		if err != nil {
@@ -131,16 +196,139 @@ func (s *HttpServer) handleSet(ctx *valse.Context) error {
 		if reader, err = file.Open(); err != nil {
 			return err
 		}
-
+		meta[keyval.MetaFilename] = file.Filename
+		if ct := file.Header.Get(strong.HeaderContentType); ct != "" && ct != "application/octet-stream" {
+			meta[keyval.MetaContentType] = ct
+		}
 	} else {
 		reader = ioutil.NopCloser(bytes.NewReader(ctx.PostBody()))
 	}
 
 	defer reader.Close()
 
-	err := s.kv.Set([]byte(name), reader)
+	requestMetadata(ctx, meta)
 
-	return err
+	ttl, err := parseTTL(ctx.Request.Header.Peek(HeaderTTL))
+	if err != nil {
+		return strong.NewHTTPError(strong.StatusBadRequest)
+	}
+
+	if store, ok := s.store.(keyval.MetadataStore); ok {
+		return s.setWithOptions(ctx, store, []byte(name[1:]), reader, keyval.SetOptions{
+			Metadata: meta,
+			TTL:      ttl,
+		})
+	}
+
+	if isConditional(ctx) {
+		if ttl > 0 {
+			return strong.NewHTTPError(strong.StatusBadRequest)
+		}
+		return s.setConditional(ctx, []byte(name[1:]), reader)
+	}
+
+	c, cancel := s.context(ctx)
+	defer cancel()
+
+	if ttl > 0 {
+		store, ok := s.store.(keyval.TTLStore)
+		if !ok {
+			return strong.NewHTTPError(strong.StatusNotImplemented)
+		}
+		// TTL stores are not context aware, so only the body is canceled
+		if err = c.Err(); err == nil {
+			err = store.SetWithTTL([]byte(name[1:]), keyval.NewContextReader(c, reader), ttl)
+		}
+	} else {
+		err = s.kv.SetContext(c, []byte(name[1:]), reader)
+	}
+
+	if err != nil {
+		return httpError(err)
+	}
+
+	return nil
+}
+
+// setWithOptions writes a value along with its metadata. Values without
+// a content type are sniffed once here, instead of on every read.
+func (s *HttpServer) setWithOptions(ctx *valse.Context, store keyval.MetadataStore, key []byte, reader io.Reader, options keyval.SetOptions) error {
+
+	if _, ok := options.Metadata[keyval.MetaContentType]; !ok {
+		m, r, err := sniff(reader)
+		if err != nil {
+			return err
+		}
+		options.Metadata[keyval.MetaContentType] = m
+		reader = r
+	}
+
+	conditional := isConditional(ctx)
+	if conditional {
+		cond, err := parseCondition(ctx)
+		if err != nil {
+			return err
+		}
+		options.Condition = cond
+	}
+
+	c, cancel := s.context(ctx)
+	defer cancel()
+
+	if err := store.SetWithOptions(c, key, reader, options); err != nil {
+		if conditional {
+			return preconditionError(err)
+		}
+		return httpError(err)
+	}
+
+	return nil
+}
+
+var errInvalidTTL = errors.New("invalid ttl")
+
+// parseTTL parses a ttl given either as a duration ("10m") or in seconds.
+// A negative ttl is rejected rather than stored without expiry.
+func parseTTL(value []byte) (time.Duration, error) {
+	if len(value) == 0 {
+		return 0, nil
+	}
+	var ttl time.Duration
+	if seconds, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+		ttl = time.Duration(seconds) * time.Second
+	} else if ttl, err = time.ParseDuration(string(value)); err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, errInvalidTTL
+	}
+	return ttl, nil
+}
+
+func (s *HttpServer) handleRemove(ctx *valse.Context) error {
+
+	name := ctx.UserValue("path").(string)
+	if name == "/" {
+		return strong.NewHTTPError(strong.StatusBadRequest)
+	}
+
+	if isConditional(ctx) {
+		return s.removeConditional(ctx, []byte(name[1:]))
+	}
+
+	c, cancel := s.context(ctx)
+	defer cancel()
+
+	removed, err := s.kv.RemoveContext(c, []byte(name[1:]))
+	if err != nil {
+		return httpError(err)
+	} else if !removed {
+		return strong.NewHTTPError(strong.StatusNotFound)
+	}
+
+	ctx.SetStatusCode(strong.StatusNoContent)
+
+	return nil
 }
 
 func (s *HttpServer) handleGet(ctx *valse.Context) error {
@@ -150,55 +338,97 @@ func (s *HttpServer) handleGet(ctx *valse.Context) error {
 		return strong.NewHTTPError(strong.StatusBadRequest)
 	}*/
 
-	if i, ok := s.kv.(keyval.KeyValMetaStore); ok {
-		stat, err := i.Stat([]byte(name[1:]))
+	c, cancel := s.context(ctx)
+	defer cancel()
+
+	var contentType string
+	if s.meta != nil {
+		stat, err := s.meta.StatContext(c, []byte(name[1:]))
 		if err != nil {
-			return err
+			return httpError(err)
 		}
+		contentType = stat.Metadata().Get(keyval.MetaContentType)
 
-		size := int(stat.Size())
-		ctx.Response.Header.SetContentLength(size)
-		ctx.Response.Header.Set("ETag", fmt.Sprintf("\"%x\"", stat.Hash))
+		if notModified(ctx, stat) {
+			setNotModified(ctx, stat)
+			return nil
+		}
 
-		return nil
+		setStatHeaders(ctx, stat)
+
+		// Ranges are only served when the size is known
+		if header := ctx.Request.Header.Peek(HeaderRange); len(header) > 0 && checkIfRange(ctx, stat) {
+			ranges, err := parseRange(string(header), stat.Size())
+			if err != nil {
+				// Written directly, as error responses drop the headers
+				ctx.SetStatusCode(strong.StatusRequestedRangeNotSatisfiable)
+				ctx.Response.Header.Set(HeaderContentRange, fmt.Sprintf("bytes */%d", stat.Size()))
+				ctx.Response.Header.SetContentLength(0)
+				return nil
+			}
+			if contentType == "" {
+				if contentType, err = s.sniffKey([]byte(name[1:])); err != nil {
+					return err
+				}
+			}
+			return s.serveRanges(ctx, []byte(name[1:]), contentType, stat.Size(), ranges)
+		}
 	}
 
-	file, err := s.kv.Get([]byte(name[1:]))
+	file, err := s.kv.GetContext(c, []byte(name[1:]))
 	if err != nil {
-		return err
+		return httpError(err)
 	}
-	var (
-		bs [64]byte
-		i  int
-		e  error
-		m  string
-	)
+	defer file.Close()
 
-	if i, e = file.Read(bs[:]); e != nil {
-		return e
+	var reader io.Reader = file
+	if contentType == "" {
+		// Values stored without metadata
+		if contentType, reader, err = sniff(file); err != nil {
+			return err
+		}
 	}
 
-	if m, e = mime.DetectContentType(bs[:]); e != nil {
-		return e
-	}
 	if s.options.MaxAge > 0 {
 		ctx.Response.Header.Set("Cache-Control", fmt.Sprintf("max-age=%d", s.options.MaxAge))
 	}
 
-	ctx.Response.Header.Set(strong.HeaderContentType, m)
-	ctx.Write(bs[:i])
+	ctx.Response.Header.Set(strong.HeaderContentType, contentType)
 
-	if i < 64 {
-		return nil
-	}
-	_, e = io.Copy(ctx, file)
+	_, err = io.Copy(ctx, reader)
 
-	return e
+	return err
+}
+
+// httpError maps store errors onto http errors. Errors are matched with
+// errors.Is, as stores may wrap them.
+func httpError(err error) error {
+	switch {
+	case errors.Is(err, keyval.ErrNotFound):
+		return strong.NewHTTPError(strong.StatusNotFound)
+	case errors.Is(err, keyval.ErrExists), errors.Is(err, keyval.ErrConflict):
+		return strong.NewHTTPError(strong.StatusConflict)
+	case errors.Is(err, keyval.ErrInvalidKey):
+		return strong.NewHTTPError(strong.StatusBadRequest)
+	case errors.Is(err, keyval.ErrReadOnly):
+		return strong.NewHTTPError(strong.StatusForbidden)
+	case errors.Is(err, keyval.ErrQuotaExceeded):
+		return strong.NewHTTPError(strong.StatusRequestEntityTooLarge)
+	case errors.Is(err, keyval.ErrTTLUnsupported):
+		return strong.NewHTTPError(strong.StatusNotImplemented)
+	case errors.Is(err, context.DeadlineExceeded):
+		return strong.NewHTTPError(strong.StatusGatewayTimeout)
+	}
+	return err
 }
 
 func NewServer(kv keyval.KeyValStore, options ServerOptions) (*HttpServer, error) {
 
-	s := &HttpServer{v: valse.New(), kv: kv, options: options}
+	s := &HttpServer{v: valse.New(), store: kv, kv: keyval.WithContext(kv), options: options}
+
+	if m, ok := kv.(keyval.KeyValMetaStore); ok {
+		s.meta = keyval.WithMetaContext(m)
+	}
 
 	err := s.init(options)
 
@@ -0,0 +1,674 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	nethttp "net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+	_ "github.com/kildevaeld/keyval/stores/filesystem"
+	_ "github.com/kildevaeld/keyval/stores/memory"
+)
+
+func startServer(t *testing.T, kv keyval.KeyValStore) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	server, err := NewServer(kv, ServerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Listen(addr)
+
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return "http://" + addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("server did not start on %s", addr)
+	return ""
+}
+
+// rawRequest sends path to the server without any client side normalization
+func rawRequest(t *testing.T, base, method, path string, body []byte) int {
+	conn, err := net.Dial("tcp", base[len("http://"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: localhost\r\nContent-Length: %d\r\nConnection: close\r\n\r\n", method, path, len(body))
+	conn.Write(body)
+
+	var (
+		proto string
+		code  int
+	)
+	if _, err := fmt.Fscanf(conn, "%s %d", &proto, &code); err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestPathTraversal(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "keyval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "store")
+
+	kv, err := keyval.Store("filesystem", map[string]interface{}{"path": root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := startServer(t, kv)
+
+	attacks := []string{
+		"/store/../escaped",
+		"/store/%2e%2e/escaped",
+		"/store/..%2fescaped",
+		"/store/..%5cescaped",
+		"/store/a/../../escaped",
+		"/store//escaped/../../escaped",
+		"/store/%2fescaped",
+		"/store/a%00b",
+		"/store/__meta",
+		"/store/.kv-tmp-escaped",
+	}
+
+	for _, path := range attacks {
+		rawRequest(t, base, "POST", path, []byte("pwned"))
+	}
+
+	// Paths may be normalized by the server, but nothing must end up outside the store
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file.Name() != "store" {
+			t.Fatalf("value written outside of the store: %s", file.Name())
+		}
+	}
+
+	if code := rawRequest(t, base, "POST", "/store/__meta", []byte("pwned")); code != nethttp.StatusBadRequest {
+		t.Fatalf("expected writing the metadata index to be rejected, got %d", code)
+	}
+
+	if code := rawRequest(t, base, "POST", "/store/a%00b", []byte("pwned")); code != nethttp.StatusBadRequest {
+		t.Fatalf("expected NUL byte key to be rejected, got %d", code)
+	}
+
+	if code := rawRequest(t, base, "GET", "/store/__meta", nil); code != nethttp.StatusBadRequest {
+		t.Fatalf("expected reading the metadata index to be rejected, got %d", code)
+	}
+
+	if code := rawRequest(t, base, "DELETE", "/store/__meta", nil); code != nethttp.StatusBadRequest {
+		t.Fatalf("expected removing the metadata index to be rejected, got %d", code)
+	}
+
+	// The store must still be usable afterwards
+	res, err := nethttp.Post(base+"/store/valid/key", "text/plain", bytes.NewReader([]byte("value")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	bs, err := kv.GetBytes([]byte("valid/key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "value" {
+		t.Fatalf("unexpected value %q", bs)
+	}
+}
+
+func request(t *testing.T, method, url string, body []byte, headers map[string]string) *nethttp.Response {
+	req, err := nethttp.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := nethttp.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res
+}
+
+func TestConditional(t *testing.T) {
+
+	kv, err := keyval.Store("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := startServer(t, kv)
+	url := base + "/store/key"
+
+	if res := request(t, "POST", url, []byte("first"), map[string]string{"If-None-Match": "*"}); res.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected create to succeed, got %d", res.StatusCode)
+	}
+
+	if res := request(t, "POST", url, []byte("second"), map[string]string{"If-None-Match": "*"}); res.StatusCode != nethttp.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for existing key, got %d", res.StatusCode)
+	}
+
+	etag := request(t, "GET", url, nil, nil).Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("expected ETag header")
+	}
+
+	if res := request(t, "POST", url, []byte("second"), map[string]string{"If-Match": etag}); res.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected matching update to succeed, got %d", res.StatusCode)
+	}
+
+	if res := request(t, "POST", url, []byte("third"), map[string]string{"If-Match": etag}); res.StatusCode != nethttp.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for stale ETag, got %d", res.StatusCode)
+	}
+
+	if res := request(t, "DELETE", url, nil, map[string]string{"If-Match": etag}); res.StatusCode != nethttp.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for stale ETag, got %d", res.StatusCode)
+	}
+
+	stale := etag
+	etag = request(t, "GET", url, nil, nil).Header.Get("ETag")
+
+	// Reads compare weakly, against any tag of a list
+	for _, header := range []string{etag, "W/" + etag, stale + ", " + etag, "*"} {
+		for _, method := range []string{"GET", "HEAD"} {
+			if res := request(t, method, url, nil, map[string]string{"If-None-Match": header}); res.StatusCode != nethttp.StatusNotModified {
+				t.Fatalf("expected 304 for %s with %s, got %d", method, header, res.StatusCode)
+			}
+		}
+	}
+	if res := request(t, "GET", url, nil, map[string]string{"If-None-Match": stale}); res.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected 200 for a stale ETag, got %d", res.StatusCode)
+	}
+
+	if res := request(t, "POST", url, []byte("second"), map[string]string{"If-Match": "W/" + etag}); res.StatusCode != nethttp.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for weak ETag, got %d", res.StatusCode)
+	}
+
+	if res := request(t, "POST", url, []byte("second"), map[string]string{"If-None-Match": "W/" + etag}); res.StatusCode != nethttp.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for current ETag, got %d", res.StatusCode)
+	}
+
+	if res := request(t, "POST", url, []byte("second"), map[string]string{"If-Match": "\"garbage"}); res.StatusCode != nethttp.StatusBadRequest {
+		t.Fatalf("expected 400 for malformed ETag, got %d", res.StatusCode)
+	}
+
+	if res := request(t, "POST", url, []byte("third"), map[string]string{"If-Match": stale + ", " + etag}); res.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected update matching a listed ETag to succeed, got %d", res.StatusCode)
+	}
+
+	if res := request(t, "POST", url, []byte("fourth"), map[string]string{"If-None-Match": stale + ", " + etag}); res.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected update matching no listed ETag to succeed, got %d", res.StatusCode)
+	}
+
+	etag = request(t, "GET", url, nil, nil).Header.Get("ETag")
+
+	if res := request(t, "DELETE", url, nil, map[string]string{"If-Match": stale + "," + etag}); res.StatusCode != nethttp.StatusNoContent {
+		t.Fatalf("expected matching delete to succeed, got %d", res.StatusCode)
+	}
+}
+
+func TestBatch(t *testing.T) {
+
+	kv, err := keyval.Store("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kv.SetBytes([]byte("old"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	base := startServer(t, kv)
+
+	body := []byte(`{"ops":[{"op":"put","key":"a","value":"dmFsdWU="},{"op":"delete","key":"old"}]}`)
+	if res := request(t, "POST", base+"/batch", body, nil); res.StatusCode != nethttp.StatusNoContent {
+		t.Fatalf("expected 204, got %d", res.StatusCode)
+	}
+
+	if bs, err := kv.GetBytes([]byte("a")); err != nil || string(bs) != "value" {
+		t.Fatalf("expected value, got %q (%v)", bs, err)
+	}
+	if has, _ := kv.Has([]byte("old")); has {
+		t.Fatal("expected old to be deleted")
+	}
+
+	if res := request(t, "POST", base+"/batch", []byte(`{"ops":[{"op":"move","key":"a"}]}`), nil); res.StatusCode != nethttp.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", res.StatusCode)
+	}
+}
+
+func TestList(t *testing.T) {
+
+	kv, err := keyval.Store("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"c", "a", "b"} {
+		kv.SetBytes([]byte(k), []byte(k))
+	}
+
+	base := startServer(t, kv)
+
+	var page struct {
+		Keys []struct {
+			Key string `json:"key"`
+		} `json:"keys"`
+		Cursor string `json:"cursor"`
+	}
+
+	get := func(query string) {
+		res, err := nethttp.Get(base + "/list?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != nethttp.StatusOK {
+			t.Fatalf("expected 200, got %d", res.StatusCode)
+		}
+		page.Keys, page.Cursor = nil, ""
+		if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get("limit=2")
+	if len(page.Keys) != 2 || page.Keys[0].Key != "a" || page.Keys[1].Key != "b" || page.Cursor == "" {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+
+	get("limit=2&cursor=" + page.Cursor)
+	if len(page.Keys) != 1 || page.Keys[0].Key != "c" || page.Cursor != "" {
+		t.Fatalf("unexpected second page: %+v", page)
+	}
+
+	get("reverse=true&end=c")
+	if len(page.Keys) != 2 || page.Keys[0].Key != "b" {
+		t.Fatalf("unexpected reverse page: %+v", page)
+	}
+
+	if res := request(t, "GET", base+"/list?cursor=!", nil, nil); res.StatusCode != nethttp.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid cursor, got %d", res.StatusCode)
+	}
+}
+
+func TestWatch(t *testing.T) {
+
+	kv, err := keyval.Store("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := startServer(t, kv)
+
+	res, err := nethttp.Get(base + "/watch?prefix=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected event stream, got %s", ct)
+	}
+
+	kv.SetBytes([]byte("b"), []byte("b"))
+	kv.SetBytes([]byte("a"), []byte("a"))
+
+	reader := bufio.NewReader(res.Body)
+	next := func() string {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Skip comments and event separators
+			if line != "\n" && !strings.HasPrefix(line, ":") {
+				return line
+			}
+		}
+	}
+
+	event, data := next(), next()
+
+	if event != "event: created\n" || data != "data: {\"type\":\"created\",\"key\":\"a\"}\n" {
+		t.Fatalf("unexpected event: %q %q", event, data)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+
+	kv, err := keyval.Store("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := startServer(t, kv)
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile(FileField, "report.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("a,b\n1,2\n"))
+	w.Close()
+
+	res := request(t, "POST", base+"/store/report", body.Bytes(), map[string]string{
+		"Content-Type":      w.FormDataContentType(),
+		"X-KV-Meta-Project": "reports",
+	})
+	if res.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+
+	res = request(t, "GET", base+"/store/report", nil, nil)
+	if v := res.Header.Get("X-KV-Meta-Project"); v != "reports" {
+		t.Fatalf("expected project metadata, got %q", v)
+	}
+	if v := res.Header.Get("Content-Disposition"); v != `inline; filename=report.csv` {
+		t.Fatalf("unexpected Content-Disposition: %q", v)
+	}
+
+	res = request(t, "POST", base+"/store/doc", []byte("{}"), map[string]string{
+		"Content-Type":     "application/json",
+		"Content-Encoding": "identity",
+	})
+	if res.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+
+	res = request(t, "HEAD", base+"/store/doc", nil, nil)
+	if v := res.Header.Get("Content-Type"); v != "application/json" {
+		t.Fatalf("expected stored content type, got %q", v)
+	}
+
+	stat, err := kv.(keyval.KeyValMetaStore).Stat([]byte("doc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Metadata().Get("Content-Encoding") != "identity" {
+		t.Fatalf("expected content encoding, got %v", stat.Metadata())
+	}
+
+	// Generic content types, as sent by curl -d, are sniffed instead
+	for _, ct := range []string{"application/x-www-form-urlencoded", "application/octet-stream"} {
+		res = request(t, "POST", base+"/store/page", []byte("<html><body>page</body></html>"), map[string]string{
+			"Content-Type": ct,
+		})
+		if res.StatusCode != nethttp.StatusOK {
+			t.Fatalf("expected 200, got %d", res.StatusCode)
+		}
+		res = request(t, "GET", base+"/store/page", nil, nil)
+		if v := res.Header.Get("Content-Type"); !strings.HasPrefix(v, "text/html") {
+			t.Fatalf("expected sniffed content type for %s, got %q", ct, v)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+
+	kv, err := keyval.Store("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.SetBytes([]byte("key"), []byte("0123456789"))
+
+	base := startServer(t, kv)
+
+	get := func(headers map[string]string) (*nethttp.Response, []byte) {
+		req, err := nethttp.NewRequest("GET", base+"/store/key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		res, err := nethttp.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, body
+	}
+
+	res, body := get(nil)
+	if res.Header.Get("Accept-Ranges") != "bytes" || string(body) != "0123456789" {
+		t.Fatalf("unexpected response: %q %q", res.Header.Get("Accept-Ranges"), body)
+	}
+
+	res, body = get(map[string]string{"Range": "bytes=2-4"})
+	if res.StatusCode != nethttp.StatusPartialContent || string(body) != "234" {
+		t.Fatalf("expected 206 with 234, got %d %q", res.StatusCode, body)
+	}
+	if v := res.Header.Get("Content-Range"); v != "bytes 2-4/10" {
+		t.Fatalf("unexpected Content-Range: %q", v)
+	}
+
+	res, body = get(map[string]string{"Range": "bytes=-3"})
+	if res.StatusCode != nethttp.StatusPartialContent || string(body) != "789" {
+		t.Fatalf("expected 206 with 789, got %d %q", res.StatusCode, body)
+	}
+
+	res, body = get(map[string]string{"Range": "bytes=0-1,8-"})
+	if res.StatusCode != nethttp.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", res.StatusCode)
+	}
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var parts []string
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		bs, _ := ioutil.ReadAll(part)
+		parts = append(parts, part.Header.Get("Content-Range")+":"+string(bs))
+	}
+	if strings.Join(parts, ",") != "bytes 0-1/10:01,bytes 8-9/10:89" {
+		t.Fatalf("unexpected parts: %v", parts)
+	}
+
+	res, _ = get(map[string]string{"Range": "bytes=20-"})
+	if res.StatusCode != nethttp.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected 416, got %d", res.StatusCode)
+	}
+	if v := res.Header.Get("Content-Range"); v != "bytes */10" {
+		t.Fatalf("unexpected Content-Range: %q", v)
+	}
+
+	// A stale If-Range returns the whole value
+	res, body = get(map[string]string{"Range": "bytes=2-4", "If-Range": `"00"`})
+	if res.StatusCode != nethttp.StatusOK || string(body) != "0123456789" {
+		t.Fatalf("expected 200 with full body, got %d %q", res.StatusCode, body)
+	}
+}
+
+func TestPatch(t *testing.T) {
+
+	kv, err := keyval.Store("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := startServer(t, kv)
+
+	request(t, "PATCH", base+"/store/log", []byte("hello"), nil)
+	res := request(t, "PATCH", base+"/store/log", []byte(" world"), nil)
+	if res.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+
+	res = request(t, "PATCH", base+"/store/log", []byte("W"), map[string]string{"X-KV-Offset": "6"})
+	if res.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+
+	if bs, _ := kv.GetBytes([]byte("log")); string(bs) != "hello World" {
+		t.Fatalf("unexpected value %q", bs)
+	}
+
+	res = request(t, "PATCH", base+"/store/log", []byte("x"), map[string]string{"X-KV-Offset": "100"})
+	if res.StatusCode != nethttp.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected 416, got %d", res.StatusCode)
+	}
+}
+
+// blockingStore blocks writes until their context is canceled
+type blockingStore struct {
+	keyval.KeyValStore
+	keyval.KeyValStoreContext
+	canceled chan error
+}
+
+func (b *blockingStore) SetContext(ctx context.Context, key []byte, reader io.Reader) error {
+	<-ctx.Done()
+	b.canceled <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestDisconnect(t *testing.T) {
+
+	kv, err := keyval.Store("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &blockingStore{kv, keyval.WithContext(kv), make(chan error, 1)}
+	base := startServer(t, store)
+
+	conn, err := net.Dial("tcp", base[len("http://"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "POST /store/key HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nvalue")
+
+	// Give the server time to start handling the request
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case err := <-store.canceled:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("write was not canceled when the client disconnected")
+	}
+}
+
+// wrappingStore wraps the errors of the store it embeds
+type wrappingStore struct {
+	keyval.KeyValStore
+}
+
+func (w *wrappingStore) Get(key []byte) (io.ReadCloser, error) {
+	reader, err := w.KeyValStore.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", key, err)
+	}
+	return reader, nil
+}
+
+func TestWrappedErrors(t *testing.T) {
+
+	kv, err := keyval.Store("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := startServer(t, &wrappingStore{kv})
+
+	if res := request(t, "GET", base+"/store/missing", nil, nil); res.StatusCode != nethttp.StatusNotFound {
+		t.Fatalf("expected 404 for a wrapped ErrNotFound, got %d", res.StatusCode)
+	}
+}
+
+// noTTLStore is a metadata store without support for expiry
+type noTTLStore struct {
+	keyval.KeyValStore
+}
+
+func (n *noTTLStore) SetWithOptions(ctx context.Context, key []byte, reader io.Reader, options keyval.SetOptions) error {
+	if options.TTL > 0 {
+		return keyval.ErrTTLUnsupported
+	}
+	return n.KeyValStore.(keyval.MetadataStore).SetWithOptions(ctx, key, reader, options)
+}
+
+func TestTTLUnsupported(t *testing.T) {
+
+	kv, err := keyval.Store("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := startServer(t, &noTTLStore{kv})
+
+	if res := request(t, "POST", base+"/store/key", []byte("value"), map[string]string{HeaderTTL: "10"}); res.StatusCode != nethttp.StatusNotImplemented {
+		t.Fatalf("expected 501 for an unsupported ttl, got %d", res.StatusCode)
+	}
+	if res := request(t, "POST", base+"/store/key", []byte("value"), nil); res.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected write without ttl to succeed, got %d", res.StatusCode)
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+
+	kv, err := keyval.Store("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := startServer(t, kv)
+
+	for _, ttl := range []string{"-5", "-1h"} {
+		if res := request(t, "POST", base+"/store/key", []byte("value"), map[string]string{HeaderTTL: ttl}); res.StatusCode != nethttp.StatusBadRequest {
+			t.Fatalf("expected 400 for ttl %s, got %d", ttl, res.StatusCode)
+		}
+	}
+	if res := request(t, "GET", base+"/store/key", nil, nil); res.StatusCode != nethttp.StatusNotFound {
+		t.Fatalf("expected rejected writes not to be stored, got %d", res.StatusCode)
+	}
+	if res := request(t, "POST", base+"/store/key", []byte("value"), map[string]string{HeaderTTL: "10m"}); res.StatusCode != nethttp.StatusOK {
+		t.Fatalf("expected write with ttl to succeed, got %d", res.StatusCode)
+	}
+}
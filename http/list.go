@@ -0,0 +1,81 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+	"github.com/kildevaeld/strong"
+	"github.com/kildevaeld/valse"
+)
+
+type listEntry struct {
+	Key   string    `json:"key"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+	Hash  string    `json:"hash,omitempty"`
+}
+
+type listResponse struct {
+	Keys   []listEntry `json:"keys"`
+	Cursor string      `json:"cursor,omitempty"`
+}
+
+// handleList lists keys in order. Query parameters are prefix, start,
+// end, reverse, limit and cursor, the latter taken from a previous response.
+func (s *HttpServer) handleList(ctx *valse.Context) error {
+	if s.meta == nil {
+		return strong.NewHTTPError(strong.StatusNotImplemented)
+	}
+
+	args := ctx.QueryArgs()
+	options := keyval.RangeOptions{
+		Prefix:  args.Peek("prefix"),
+		Reverse: args.GetBool("reverse"),
+		Cursor:  string(args.Peek("cursor")),
+	}
+	if args.Has("start") {
+		options.Start = args.Peek("start")
+	}
+	if args.Has("end") {
+		options.End = args.Peek("end")
+	}
+	if args.Has("limit") {
+		limit, err := args.GetUint("limit")
+		if err != nil {
+			return strong.NewHTTPError(strong.StatusBadRequest)
+		}
+		options.Limit = limit
+	}
+
+	c, cancel := s.context(ctx)
+	defer cancel()
+
+	res := listResponse{Keys: []listEntry{}}
+	cursor, err := keyval.Range(c, s.store.(keyval.KeyValMetaStore), options, func(key []byte, stat keyval.Stat) error {
+		entry := listEntry{Key: string(key), Size: stat.Size(), Mtime: stat.Mtime()}
+		if hash := stat.Hash(); len(hash) > 0 {
+			entry.Hash = fmt.Sprintf("%x", hash)
+		}
+		res.Keys = append(res.Keys, entry)
+		return nil
+	})
+	if errors.Is(err, keyval.ErrInvalidCursor) {
+		return strong.NewHTTPError(strong.StatusBadRequest)
+	} else if err != nil {
+		return httpError(err)
+	}
+	res.Cursor = cursor
+
+	bs, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	ctx.Response.Header.Set(strong.HeaderContentType, "application/json")
+	ctx.Write(bs)
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	stdmime "mime"
+	"strings"
+
+	"github.com/kildevaeld/bproxy/mime"
+	"github.com/kildevaeld/keyval"
+	"github.com/kildevaeld/strong"
+	"github.com/kildevaeld/valse"
+)
+
+// HeaderMetaPrefix prefixes headers carrying user defined metadata
+const HeaderMetaPrefix = "X-KV-Meta-"
+
+// genericContentTypes are sent by clients regardless of the content,
+// like curl -d does, and are sniffed instead of stored.
+var genericContentTypes = map[string]bool{
+	"application/x-www-form-urlencoded": true,
+	"multipart/form-data":               true,
+	"application/octet-stream":          true,
+}
+
+// requestMetadata collects the metadata of an upload from the request
+// headers. The content type of multipart uploads is taken from the part.
+func requestMetadata(ctx *valse.Context, meta keyval.Metadata) {
+	if _, ok := meta[keyval.MetaContentType]; !ok {
+		ct := string(ctx.Request.Header.ContentType())
+		if mt, _, err := stdmime.ParseMediaType(ct); err == nil && !genericContentTypes[mt] {
+			meta[keyval.MetaContentType] = ct
+		}
+	}
+	if enc := ctx.Request.Header.Peek("Content-Encoding"); len(enc) > 0 {
+		meta[keyval.MetaContentEncoding] = string(enc)
+	}
+
+	prefix := []byte(strings.ToLower(HeaderMetaPrefix))
+	ctx.Request.Header.VisitAll(func(key, value []byte) {
+		key = bytes.ToLower(key)
+		if bytes.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			meta[string(key[len(prefix):])] = string(value)
+		}
+	})
+}
+
+// setMetadataHeaders is the counterpart of requestMetadata.
+func setMetadataHeaders(ctx *valse.Context, meta keyval.Metadata) {
+	for name, value := range meta {
+		switch name {
+		case keyval.MetaContentType:
+			ctx.Response.Header.Set(strong.HeaderContentType, value)
+		case keyval.MetaContentEncoding:
+			ctx.Response.Header.Set("Content-Encoding", value)
+		case keyval.MetaFilename:
+			ctx.Response.Header.Set("Content-Disposition", stdmime.FormatMediaType("inline", map[string]string{"filename": value}))
+			ctx.Response.Header.Set(HeaderMetaPrefix+"Filename", value)
+		default:
+			ctx.Response.Header.Set(HeaderMetaPrefix+name, value)
+		}
+	}
+}
+
+// sniff detects the content type of reader from its first 64 bytes,
+// and returns a reader yielding the full content.
+func sniff(reader io.Reader) (string, io.Reader, error) {
+	var bs [64]byte
+	i, err := io.ReadFull(reader, bs[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	m, err := mime.DetectContentType(bs[:i])
+	if err != nil {
+		return "", nil, err
+	}
+	return m, io.MultiReader(bytes.NewReader(bs[:i]), reader), nil
+}
@@ -0,0 +1,44 @@
+package http
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/kildevaeld/keyval"
+	"github.com/kildevaeld/strong"
+	"github.com/kildevaeld/valse"
+)
+
+// HeaderOffset is the offset a PATCH request writes at. Without it the
+// body is appended to the value.
+const HeaderOffset = "X-KV-Offset"
+
+func (s *HttpServer) handlePatch(ctx *valse.Context) error {
+
+	name := ctx.UserValue("path").(string)
+	if name == "/" {
+		return strong.NewHTTPError(strong.StatusBadRequest)
+	}
+
+	c, cancel := s.context(ctx)
+	defer cancel()
+
+	reader := bytes.NewReader(ctx.PostBody())
+
+	var err error
+	if header := ctx.Request.Header.Peek(HeaderOffset); len(header) > 0 {
+		offset, e := strconv.ParseInt(string(header), 10, 64)
+		if e != nil || offset < 0 {
+			return strong.NewHTTPError(strong.StatusBadRequest)
+		}
+		err = keyval.WriteAtContext(c, s.store, []byte(name[1:]), offset, reader)
+	} else {
+		err = keyval.AppendContext(c, s.store, []byte(name[1:]), reader)
+	}
+
+	if err != nil {
+		return rangeError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+	"github.com/kildevaeld/strong"
+	"github.com/kildevaeld/valse"
+)
+
+const (
+	HeaderRange        = "Range"
+	HeaderIfRange      = "If-Range"
+	HeaderAcceptRanges = "Accept-Ranges"
+	HeaderContentRange = "Content-Range"
+)
+
+var errInvalidRange = errors.New("invalid range")
+
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a "bytes=" Range header against a value of size bytes.
+// Ranges starting past the end are dropped; if none are left the range
+// is unsatisfiable and errInvalidRange is returned.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errInvalidRange
+	}
+
+	var ranges []byteRange
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, errInvalidRange
+		}
+		start, end := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+		var r byteRange
+		if start == "" {
+			// Suffix range, the last n bytes
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{size - n, n}
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errInvalidRange
+			}
+			if i >= size {
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = size - i
+			} else {
+				j, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || j < i {
+					return nil, errInvalidRange
+				}
+				if j >= size {
+					j = size - 1
+				}
+				r.length = j - i + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errInvalidRange
+	}
+
+	return ranges, nil
+}
+
+// checkIfRange reports whether the Range header should be honoured,
+// which is when If-Range is missing or still matches the value.
+func checkIfRange(ctx *valse.Context, stat keyval.Stat) bool {
+	ifRange := string(ctx.Request.Header.Peek(HeaderIfRange))
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") {
+		return len(stat.Hash()) > 0 && ifRange == etag(stat.Hash())
+	}
+	t, err := time.Parse(time.RFC1123, ifRange)
+	if err != nil || stat.Mtime().IsZero() {
+		return false
+	}
+	return !stat.Mtime().Truncate(time.Second).After(t)
+}
+
+// serveRanges writes the requested ranges of key as a 206 Partial Content
+// response, using multipart/byteranges when there are more than one.
+func (s *HttpServer) serveRanges(ctx *valse.Context, key []byte, contentType string, size int64, ranges []byteRange) error {
+	if len(ranges) == 1 {
+		r := ranges[0]
+		reader, err := keyval.GetRange(s.store, key, r.start, r.length)
+		if err != nil {
+			return rangeError(err)
+		}
+		defer reader.Close()
+
+		ctx.SetStatusCode(strong.StatusPartialContent)
+		ctx.Response.Header.Set(strong.HeaderContentType, contentType)
+		ctx.Response.Header.Set(HeaderContentRange, r.contentRange(size))
+		ctx.Response.Header.SetContentLength(int(r.length))
+		_, err = io.Copy(ctx, reader)
+		return err
+	}
+
+	mw := multipart.NewWriter(ctx)
+	for _, r := range ranges {
+		reader, err := keyval.GetRange(s.store, key, r.start, r.length)
+		if err != nil {
+			return rangeError(err)
+		}
+
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			strong.HeaderContentType: {contentType},
+			HeaderContentRange:       {r.contentRange(size)},
+		})
+		if err == nil {
+			_, err = io.Copy(part, reader)
+		}
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx.SetStatusCode(strong.StatusPartialContent)
+	ctx.Response.Header.Set(strong.HeaderContentType, "multipart/byteranges; boundary="+mw.Boundary())
+	return mw.Close()
+}
+
+// sniffKey detects the content type of a value stored without one.
+func (s *HttpServer) sniffKey(key []byte) (string, error) {
+	reader, err := keyval.GetRange(s.store, key, 0, 64)
+	if err != nil {
+		return "", httpError(err)
+	}
+	defer reader.Close()
+	contentType, _, err := sniff(reader)
+	return contentType, err
+}
+
+func rangeError(err error) error {
+	if errors.Is(err, keyval.ErrInvalidRange) {
+		return strong.NewHTTPError(strong.StatusRequestedRangeNotSatisfiable)
+	}
+	return httpError(err)
+}
@@ -0,0 +1,76 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+	"github.com/kildevaeld/strong"
+	"github.com/kildevaeld/valse"
+)
+
+// WatchHeartbeat is the interval between keep-alive comments sent to
+// watchers, which is also how quickly a closed connection is noticed.
+var WatchHeartbeat = 15 * time.Second
+
+type watchEvent struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+}
+
+// handleWatch streams changes to keys matching the prefix query
+// parameter as server-sent events.
+func (s *HttpServer) handleWatch(ctx *valse.Context) error {
+	watcher, ok := s.store.(keyval.Watcher)
+	if !ok {
+		return strong.NewHTTPError(strong.StatusNotImplemented)
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+
+	events, err := watcher.Watch(c, ctx.QueryArgs().Peek("prefix"))
+	if err != nil {
+		cancel()
+		return httpError(err)
+	}
+
+	ctx.Response.Header.Set(strong.HeaderContentType, "text/event-stream")
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+
+		ticker := time.NewTicker(WatchHeartbeat)
+		defer ticker.Stop()
+
+		// Headers are only sent along with the first part of the body
+		w.WriteString(": watching\n\n")
+		if err := w.Flush(); err != nil {
+			return
+		}
+
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				bs, err := json.Marshal(watchEvent{event.Type.String(), string(event.Key)})
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, bs)
+			case <-ticker.C:
+				w.WriteString(": keep-alive\n\n")
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+
+	return nil
+}
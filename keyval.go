@@ -1,18 +1,27 @@
 package keyval
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"time"
 
+	"github.com/gobwas/glob"
 	"github.com/mitchellh/mapstructure"
 )
 
 var (
-	ErrNotFound = errors.New("not found")
-	ErrStopIter = errors.New("stop iterater")
+	ErrNotFound      = errors.New("not found")
+	ErrStopIter      = errors.New("stop iterater")
+	ErrExists        = errors.New("already exists")
+	ErrReadOnly      = errors.New("store is read-only")
+	ErrInvalidKey    = errors.New("invalid key")
+	ErrConflict      = errors.New("conflict")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrTTLUnsupported is returned by stores which can't expire values
+	ErrTTLUnsupported = errors.New("store does not support ttl")
 )
 
 /*type ValueInfo struct {
@@ -25,8 +34,8 @@ type KeyValStoreFactory func(options interface{}) (KeyValStore, error)
 type KeyValStore interface {
 	Set(key []byte, reader io.Reader) error
 	SetBytes(key []byte, bytes []byte) error
-	Has(bs []byte) bool
-	Remove(key []byte) bool
+	Has(key []byte) (bool, error)
+	Remove(key []byte) (bool, error)
 	Get(key []byte) (io.ReadCloser, error)
 	GetBytes(key []byte) ([]byte, error)
 }
@@ -37,6 +46,11 @@ type Stat interface {
 	Ctime() time.Time
 	Hash() []byte
 	IsDir() bool
+	// Expires returns the time the value expires, or the zero time
+	// if it never does.
+	Expires() time.Time
+	// Metadata returns the metadata stored with the value, or nil.
+	Metadata() Metadata
 }
 
 type KeyValMetaStore interface {
@@ -70,18 +84,48 @@ func GetOptions(options interface{}, out interface{}) error {
 	case string:
 		err = json.Unmarshal([]byte(t), out)
 	case map[string]interface{}:
-		err = mapstructure.Decode(t, out)
+		var decoder *mapstructure.Decoder
+		decoder, err = mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			// Durations are commonly written as strings, eg. "30s"
+			DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
+			Result:     out,
+		})
+		if err == nil {
+			err = decoder.Decode(t)
+		}
 	}
 
 	return err
 }
 
+// Matcher returns a function matching keys against pattern.
+// Patterns containing glob meta characters are compiled as globs,
+// all other patterns are matched as key prefixes.
+func Matcher(pattern []byte) (func(key []byte) bool, error) {
+	if !bytes.ContainsAny(pattern, "*?[{\\") {
+		return func(key []byte) bool {
+			return bytes.HasPrefix(key, pattern)
+		}, nil
+	}
+
+	g, err := glob.Compile(string(pattern), '/')
+	if err != nil {
+		return nil, err
+	}
+
+	return func(key []byte) bool {
+		return g.Match(string(key))
+	}, nil
+}
+
 type stat_impl struct {
-	size  int64
-	hash  []byte
-	ctime time.Time
-	mtime time.Time
-	isDir bool
+	size    int64
+	hash    []byte
+	ctime   time.Time
+	mtime   time.Time
+	isDir   bool
+	expires time.Time
+	meta    Metadata
 }
 
 func (s *stat_impl) Size() int64 {
@@ -99,9 +143,27 @@ func (s *stat_impl) Hash() []byte {
 func (s *stat_impl) IsDir() bool {
 	return s.isDir
 }
+func (s *stat_impl) Expires() time.Time {
+	return s.expires
+}
+func (s *stat_impl) Metadata() Metadata {
+	return s.meta
+}
 
 func NewState(s int64, h []byte, c time.Time, m time.Time) Stat {
 	return &stat_impl{
-		s, h, c, m, false,
+		s, h, c, m, false, time.Time{}, nil,
+	}
+}
+
+func NewStateExpires(s int64, h []byte, c time.Time, m time.Time, e time.Time) Stat {
+	return &stat_impl{
+		s, h, c, m, false, e, nil,
+	}
+}
+
+func NewStateMetadata(s int64, h []byte, c time.Time, m time.Time, e time.Time, meta Metadata) Stat {
+	return &stat_impl{
+		s, h, c, m, false, e, meta,
 	}
 }
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/kildevaeld/keyval"
+	"github.com/spf13/cobra"
+)
+
+var offsetFlag int64
+
+// appendCmd represents the append command
+var appendCmd = &cobra.Command{
+	Use:   "append <key> [value]",
+	Short: "Append to a value, or write into it at an offset",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := appendImpl(cmd, args); err != nil {
+			printError(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(appendCmd)
+
+	appendCmd.Flags().Int64Var(&offsetFlag, "offset", -1, "write at offset instead of appending")
+}
+
+func appendImpl(cmd *cobra.Command, args []string) error {
+	if len(args) < 2 && !isPiped() {
+		return errors.New("usage: kv append <key> <value>")
+	} else if len(args) == 0 {
+		return errors.New("usage: kv append <key>")
+	}
+
+	kv, err := getKeyValueStore()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := getContext()
+	defer cancel()
+
+	var reader io.Reader = os.Stdin
+	if !isPiped() {
+		reader = strings.NewReader(args[1])
+	}
+
+	if offsetFlag >= 0 {
+		return keyval.WriteAtContext(ctx, kv, []byte(args[0]), offsetFlag, reader)
+	}
+	return keyval.AppendContext(ctx, kv, []byte(args[0]), reader)
+}
@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/kildevaeld/keyval"
 	"github.com/spf13/viper"
@@ -21,3 +24,32 @@ func getKeyValueStore() (keyval.KeyValStore, error) {
 	return keyval.Store(t, i)
 
 }
+
+// getContext returns a context, which is cancelled on interrupt or
+// when the --timeout duration has elapsed.
+func getContext() (context.Context, context.CancelFunc) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	if timeoutFlag > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeoutFlag)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sig)
+	}()
+
+	return ctx, cancel
+}
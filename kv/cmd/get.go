@@ -14,15 +14,21 @@
 package cmd
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"sort"
 
 	"github.com/kildevaeld/keyval"
 	"github.com/spf13/cobra"
 )
 
-var outputFlag string
+var (
+	outputFlag  string
+	getMetaFlag bool
+)
 
 // getCmd represents the get command
 var getCmd = &cobra.Command{
@@ -41,6 +47,7 @@ func init() {
 	RootCmd.AddCommand(getCmd)
 
 	getCmd.Flags().StringVarP(&outputFlag, "output", "o", "", "")
+	getCmd.Flags().BoolVar(&getMetaFlag, "meta", false, "print metadata instead of the value")
 
 }
 
@@ -60,14 +67,22 @@ func getImpl(cm *cobra.Command, args []string) error {
 		return err
 	}
 
+	ctx, cancel := getContext()
+	defer cancel()
+
+	if getMetaFlag {
+		return printMetadata(ctx, kv, []byte(args[0]))
+	}
+
 	out := os.Stdout
 	if outputFlag != "" {
-		if out, err = os.Create(args[0]); err != nil {
+		if out, err = os.Create(outputFlag); err != nil {
 			return err
 		}
+		defer out.Close()
 	}
 
-	if file, err = kv.Get([]byte(args[0])); err != nil {
+	if file, err = keyval.WithContext(kv).GetContext(ctx, []byte(args[0])); err != nil {
 		return err
 	}
 	defer file.Close()
@@ -76,3 +91,28 @@ func getImpl(cm *cobra.Command, args []string) error {
 
 	return err
 }
+
+func printMetadata(ctx context.Context, kv keyval.KeyValStore, key []byte) error {
+	meta, ok := kv.(keyval.KeyValMetaStore)
+	if !ok {
+		return errors.New("store does not support metadata")
+	}
+
+	stat, err := keyval.WithMetaContext(meta).StatContext(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	m := stat.Metadata()
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("%s: %s\n", name, m[name])
+	}
+
+	return nil
+}
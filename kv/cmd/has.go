@@ -14,36 +14,53 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"os"
 
+	"github.com/kildevaeld/keyval"
 	"github.com/spf13/cobra"
 )
 
 // hasCmd represents the has command
 var hasCmd = &cobra.Command{
 	Use:   "has",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+	Short: "Check whether a key exists",
+	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("has called")
+		if err := hasImpl(cmd, args); err != nil {
+			printError(err)
+		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(hasCmd)
+}
+
+func hasImpl(cmd *cobra.Command, args []string) error {
+
+	if len(args) == 0 {
+		return errors.New("usage: kv has <key>")
+	}
+
+	kv, err := getKeyValueStore()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := getContext()
+	defer cancel()
 
-	// Here you will define your flags and configuration settings.
+	has, err := keyval.WithContext(kv).HasContext(ctx, []byte(args[0]))
+	if err != nil {
+		return err
+	}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// hasCmd.PersistentFlags().String("foo", "", "A help for foo")
+	fmt.Println(has)
+	if !has {
+		os.Exit(1)
+	}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// hasCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	return nil
 }
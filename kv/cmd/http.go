@@ -15,6 +15,7 @@ package cmd
 
 import (
 	"os"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -61,11 +62,23 @@ func httpImpl(cmd *cobra.Command, args []string) error {
 	options := http.ServerOptions{
 		WorkQueue:  viper.GetInt("http.work_queue"),
 		ScriptPath: system.Environ(os.Environ()).Expand(viper.GetString("http.script_path")),
+		Timeout:    viper.GetDuration("http.timeout"),
 	}
 
 	if server, err = http.NewServer(kv, options); err != nil {
 		return err
 	}
+
+	if store, ok := kv.(keyval.Expirer); ok {
+		interval := viper.GetDuration("http.reap_interval")
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		reaper := keyval.NewReaper(store, interval)
+		reaper.Start()
+		defer reaper.Stop()
+	}
+
 	zap.L().Sugar().Infof("kv:http started on %s", httpAddressFlag)
 	return server.Listen(httpAddressFlag)
 }
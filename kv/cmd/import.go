@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kildevaeld/keyval"
+	"github.com/spf13/cobra"
+)
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import <dir> [prefix]",
+	Short: "Import all files in a directory",
+	Long: `Import all files below dir, keyed by their path relative to dir.
+Files are written in batches of --batch-size.`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := importImpl(cmd, args); err != nil {
+			printError(err)
+		}
+
+	},
+}
+
+var batchSizeFlag int
+
+func init() {
+	RootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().IntVar(&batchSizeFlag, "batch-size", 100, "number of files per batch")
+}
+
+func importImpl(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("usage: kv import <dir> [prefix]")
+	}
+
+	kv, err := getKeyValueStore()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := getContext()
+	defer cancel()
+
+	root := args[0]
+	prefix := ""
+	if len(args) == 2 {
+		prefix = args[1]
+	}
+
+	batch := keyval.NewBatch(kv)
+	count := 0
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		batch.Put([]byte(prefix+filepath.ToSlash(rel)), bs)
+
+		if batch.Len() >= batchSizeFlag {
+			count += batch.Len()
+			return batch.Commit()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	count += batch.Len()
+	if err := batch.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("imported %d files\n", count)
+
+	return nil
+}
@@ -21,36 +21,90 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"time"
 
+	"github.com/kildevaeld/keyval"
 	"github.com/spf13/cobra"
 )
 
+var (
+	longFlag   bool
+	rangeFlags keyval.RangeOptions
+	startFlag  string
+	endFlag    string
+	cursorFlag string
+)
+
 // listCmd represents the list command
 var listCmd = &cobra.Command{
-	Use:   "list",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List keys matching a prefix or glob",
+	Long:    ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("list called")
+		if err := listImpl(cmd, args); err != nil {
+			printError(err)
+		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(listCmd)
 
-	// Here you will define your flags and configuration settings.
+	listCmd.Flags().BoolVarP(&longFlag, "long", "l", false, "print size and modification time")
+	listCmd.Flags().StringVar(&startFlag, "start", "", "first key to list")
+	listCmd.Flags().StringVar(&endFlag, "end", "", "list keys before this key")
+	listCmd.Flags().BoolVarP(&rangeFlags.Reverse, "reverse", "r", false, "list in reverse order")
+	listCmd.Flags().IntVarP(&rangeFlags.Limit, "limit", "n", 0, "maximum number of keys to list")
+	listCmd.Flags().StringVar(&cursorFlag, "cursor", "", "continue from a previous listing")
+}
+
+func listImpl(cmd *cobra.Command, args []string) error {
+
+	kv, err := getKeyValueStore()
+	if err != nil {
+		return err
+	}
+
+	meta, ok := kv.(keyval.KeyValMetaStore)
+	if !ok {
+		return errors.New("store does not support listing")
+	}
+
+	options := rangeFlags
+	if len(args) > 0 {
+		options.Prefix = []byte(args[0])
+	}
+	if startFlag != "" {
+		options.Start = []byte(startFlag)
+	}
+	if endFlag != "" {
+		options.End = []byte(endFlag)
+	}
+	options.Cursor = cursorFlag
+
+	ctx, cancel := getContext()
+	defer cancel()
+
+	cursor, err := keyval.Range(ctx, meta, options, func(key []byte, stat keyval.Stat) error {
+		if longFlag {
+			fmt.Printf("%10d  %s  %s\n", stat.Size(), stat.Mtime().Format(time.RFC3339), key)
+		} else {
+			fmt.Printf("%s\n", key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// listCmd.PersistentFlags().String("foo", "", "A help for foo")
+	// Printed to stderr, so the listing itself can be piped
+	if cursor != "" {
+		fmt.Fprintf(os.Stderr, "next: --cursor %s\n", cursor)
+	}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// listCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	return nil
 }
@@ -16,6 +16,7 @@ package cmd
 import (
 	"errors"
 
+	"github.com/kildevaeld/keyval"
 	"github.com/spf13/cobra"
 )
 
@@ -47,7 +48,15 @@ func removeImple(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	kv.Remove([]byte(args[0]))
+	ctx, cancel := getContext()
+	defer cancel()
+
+	removed, err := keyval.WithContext(kv).RemoveContext(ctx, []byte(args[0]))
+	if err != nil {
+		return err
+	} else if !removed {
+		return keyval.ErrNotFound
+	}
 
 	return nil
 }
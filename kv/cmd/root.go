@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -28,6 +29,7 @@ import (
 
 var cfgFile string
 var debugFlag bool
+var timeoutFlag time.Duration
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -60,6 +62,7 @@ func init() {
 	// when this action is called directly.
 	RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	RootCmd.PersistentFlags().BoolVar(&debugFlag, "debug", false, "debug")
+	RootCmd.PersistentFlags().DurationVar(&timeoutFlag, "timeout", 0, "abort the operation after duration")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -14,8 +14,13 @@
 package cmd
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/kildevaeld/keyval"
 	"github.com/spf13/cobra"
@@ -50,8 +55,16 @@ func validateArgs(args []string) error {
 	return nil
 }
 
+var (
+	ttlFlag  time.Duration
+	metaFlag []string
+)
+
 func init() {
 	RootCmd.AddCommand(setCmd)
+
+	setCmd.Flags().DurationVar(&ttlFlag, "ttl", 0, "expire the value after duration")
+	setCmd.Flags().StringArrayVar(&metaFlag, "meta", nil, "store metadata with the value, as name=value")
 }
 
 func setImpl(cmd *cobra.Command, args []string) error {
@@ -68,13 +81,58 @@ func setImpl(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	ctx, cancel := getContext()
+	defer cancel()
+
 	name := []byte(args[0])
+	kc := keyval.WithContext(kv)
+
+	if len(metaFlag) > 0 {
+		return setWithMetadata(ctx, kv, name, args)
+	}
+
+	if ttlFlag > 0 {
+		store, ok := kv.(keyval.TTLStore)
+		if !ok {
+			return errors.New("store does not support ttl")
+		}
+		if isPiped() {
+			return store.SetWithTTL(name, keyval.NewContextReader(ctx, os.Stdin), ttlFlag)
+		}
+		return store.SetBytesWithTTL(name, []byte(args[1]), ttlFlag)
+	}
 
 	if isPiped() {
-		err = kv.Set(name, os.Stdin)
+		err = kc.SetContext(ctx, name, os.Stdin)
 	} else {
-		err = kv.SetBytes(name, []byte(args[1]))
+		err = kc.SetBytesContext(ctx, name, []byte(args[1]))
 	}
 
 	return err
 }
+
+func setWithMetadata(ctx context.Context, kv keyval.KeyValStore, key []byte, args []string) error {
+	store, ok := kv.(keyval.MetadataStore)
+	if !ok {
+		return errors.New("store does not support metadata")
+	}
+
+	meta := keyval.Metadata{}
+	for _, m := range metaFlag {
+		i := strings.Index(m, "=")
+		if i <= 0 {
+			return fmt.Errorf("invalid metadata: %s, expected name=value", m)
+		}
+		meta.Set(m[:i], m[i+1:])
+	}
+
+	var reader io.Reader = os.Stdin
+	if !isPiped() {
+		reader = strings.NewReader(args[1])
+	}
+
+	return store.SetWithOptions(ctx, key, reader, keyval.SetOptions{
+		Metadata: meta,
+		TTL:      ttlFlag,
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+	"github.com/spf13/cobra"
+)
+
+// statCmd represents the stat command
+var statCmd = &cobra.Command{
+	Use:   "stat",
+	Short: "Show size, times and content hash of a key",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := statImpl(cmd, args); err != nil {
+			printError(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(statCmd)
+}
+
+func statImpl(cmd *cobra.Command, args []string) error {
+
+	if len(args) == 0 {
+		return errors.New("usage: kv stat <key>")
+	}
+
+	kv, err := getKeyValueStore()
+	if err != nil {
+		return err
+	}
+
+	meta, ok := kv.(keyval.KeyValMetaStore)
+	if !ok {
+		return errors.New("store does not support stat")
+	}
+
+	ctx, cancel := getContext()
+	defer cancel()
+
+	stat, err := keyval.WithMetaContext(meta).StatContext(ctx, []byte(args[0]))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Key:     %s\n", args[0])
+	fmt.Printf("Size:    %d\n", stat.Size())
+	fmt.Printf("Ctime:   %s\n", stat.Ctime().Format(time.RFC3339))
+	fmt.Printf("Mtime:   %s\n", stat.Mtime().Format(time.RFC3339))
+	fmt.Printf("Hash:    %x\n", stat.Hash())
+	if expires := stat.Expires(); !expires.IsZero() {
+		fmt.Printf("Expires: %s\n", expires.Format(time.RFC3339))
+	}
+
+	return nil
+}
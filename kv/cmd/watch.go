@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kildevaeld/keyval"
+	"github.com/spf13/cobra"
+)
+
+// watchCmd represents the watch command
+var watchCmd = &cobra.Command{
+	Use:   "watch [prefix]",
+	Short: "Print changes to keys matching a prefix or glob",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := watchImpl(cmd, args); err != nil {
+			printError(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(watchCmd)
+}
+
+func watchImpl(cmd *cobra.Command, args []string) error {
+
+	kv, err := getKeyValueStore()
+	if err != nil {
+		return err
+	}
+
+	watcher, ok := kv.(keyval.Watcher)
+	if !ok {
+		return errors.New("store does not support watching")
+	}
+
+	var prefix []byte
+	if len(args) > 0 {
+		prefix = []byte(args[0])
+	}
+
+	ctx, cancel := getContext()
+	defer cancel()
+
+	events, err := watcher.Watch(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	for event := range events {
+		fmt.Printf("%s\t%s\n", event.Type, event.Key)
+	}
+
+	return nil
+}
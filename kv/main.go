@@ -16,6 +16,11 @@ package main
 import "github.com/kildevaeld/keyval/kv/cmd"
 import _ "github.com/kildevaeld/keyval/stores/memory"
 import _ "github.com/kildevaeld/keyval/stores/filesystem"
+import _ "github.com/kildevaeld/keyval/stores/bolt"
+import _ "github.com/kildevaeld/keyval/stores/badger"
+import _ "github.com/kildevaeld/keyval/stores/sqlite"
+import _ "github.com/kildevaeld/keyval/stores/redis"
+import _ "github.com/kildevaeld/keyval/stores/s3"
 
 func main() {
 
@@ -0,0 +1,53 @@
+package keyval
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+)
+
+// Well known metadata names. Other names are free for applications to use.
+const (
+	MetaContentType     = "content-type"
+	MetaFilename        = "filename"
+	MetaContentEncoding = "content-encoding"
+)
+
+// Metadata is stored along with a value, and replaced when the value is.
+// Names are case insensitive, and kept in lower case.
+type Metadata map[string]string
+
+func (m Metadata) Get(name string) string {
+	return m[strings.ToLower(name)]
+}
+
+func (m Metadata) Set(name, value string) {
+	m[strings.ToLower(name)] = value
+}
+
+func (m Metadata) Copy() Metadata {
+	if m == nil {
+		return nil
+	}
+	out := make(Metadata, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// SetOptions are optional parameters for SetWithOptions.
+type SetOptions struct {
+	Metadata Metadata
+	// TTL expires the value after the duration, see TTLStore
+	TTL time.Duration
+	// Condition must accept the current value, see ConditionalStore
+	Condition Condition
+}
+
+// MetadataStore is implemented by stores persisting metadata with values.
+// Writing a value through any other method clears its metadata.
+type MetadataStore interface {
+	SetWithOptions(ctx context.Context, key []byte, reader io.Reader, options SetOptions) error
+}
@@ -0,0 +1,55 @@
+package keyval
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var ErrInvalidRange = errors.New("invalid range")
+
+// RangeReader is implemented by stores, which can read part of a value
+// without reading what comes before it. A negative length reads to the
+// end of the value. An offset past the end of the value is invalid.
+type RangeReader interface {
+	GetRange(key []byte, offset, length int64) (io.ReadCloser, error)
+}
+
+// GetRange reads part of a value. Stores not implementing RangeReader
+// have the bytes before offset read and discarded.
+func GetRange(store KeyValStore, key []byte, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, ErrInvalidRange
+	}
+	if r, ok := store.(RangeReader); ok {
+		return r.GetRange(key, offset, length)
+	}
+
+	reader, err := store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, reader, offset); err != nil {
+		reader.Close()
+		if err == io.EOF {
+			return nil, ErrInvalidRange
+		}
+		return nil, err
+	}
+
+	return LimitReadCloser(reader, length), nil
+}
+
+// LimitReadCloser limits reader to length bytes, unless length is negative.
+func LimitReadCloser(reader io.ReadCloser, length int64) io.ReadCloser {
+	if length < 0 {
+		return reader
+	}
+	return &limitReadCloser{io.LimitReader(reader, length), reader}
+}
+
+type limitReadCloser struct {
+	io.Reader
+	io.Closer
+}
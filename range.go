@@ -0,0 +1,337 @@
+package keyval
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"sort"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type RangeOptions struct {
+	// Prefix or glob pattern, as accepted by List
+	Prefix []byte
+	// Start is the first key included, End the first key excluded
+	Start []byte
+	End   []byte
+	// Reverse iterates from End towards Start
+	Reverse bool
+	// Limit is the maximum number of keys returned, or 0 for no limit
+	Limit int
+	// Cursor continues a previous iteration with the same options
+	Cursor string
+}
+
+// RangeStore is implemented by stores, which can iterate keys in order.
+// Range calls fn for each key in the range, and returns a cursor
+// for the next page, which is empty when there are no more keys.
+type RangeStore interface {
+	Range(ctx context.Context, options RangeOptions, fn func(key []byte, meta Stat) error) (string, error)
+}
+
+// Range iterates store in key order. Stores not implementing RangeStore
+// are listed in full and sorted, before the range is applied.
+func Range(ctx context.Context, store KeyValMetaStore, options RangeOptions, fn func(key []byte, meta Stat) error) (string, error) {
+	if r, ok := store.(RangeStore); ok {
+		return r.Range(ctx, options, fn)
+	}
+
+	stats := make(map[string]Stat)
+	var keys [][]byte
+	err := WithMetaContext(store).ListContext(ctx, options.Prefix, func(key []byte, meta Stat) error {
+		k := make([]byte, len(key))
+		copy(k, key)
+		keys = append(keys, k)
+		stats[string(k)] = meta
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	SortKeys(keys)
+
+	return RangeSorted(ctx, keys, func(key []byte) (Stat, error) {
+		return stats[string(key)], nil
+	}, options, fn)
+}
+
+func SortKeys(keys [][]byte) {
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+}
+
+// RangeSorted applies options to keys, which must be sorted in
+// ascending order. Keys for which stat returns ErrNotFound are skipped.
+func RangeSorted(ctx context.Context, keys [][]byte, stat func(key []byte) (Stat, error), options RangeOptions, fn func(key []byte, meta Stat) error) (string, error) {
+	match, err := Matcher(options.Prefix)
+	if err != nil {
+		return "", err
+	}
+
+	lo, hi, err := bounds(keys, options)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		count int
+		last  []byte
+	)
+	for n := 0; n < hi-lo; n++ {
+		i := lo + n
+		if options.Reverse {
+			i = hi - 1 - n
+		}
+		key := keys[i]
+		if !match(key) {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		meta, err := stat(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		if options.Limit > 0 && count == options.Limit {
+			// There is at least one more key
+			return EncodeCursor(last), nil
+		}
+
+		if err := fn(key, meta); err != nil {
+			if errors.Is(err, ErrStopIter) {
+				return EncodeCursor(key), nil
+			}
+			return "", err
+		}
+		count++
+		last = key
+	}
+
+	return "", nil
+}
+
+// RangeBounds returns the keys a page of options lies within, from lower
+// up to but excluding upper. A nil bound is open. The bounds take the
+// literal prefix of options.Prefix and the cursor into account, so stores
+// iterating in order can seek to lower.
+func RangeBounds(options RangeOptions) (lower, upper []byte, err error) {
+	after, err := DecodeCursor(options.Cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prefix := LiteralPrefix(options.Prefix)
+	lower = maxKey(options.Start, prefix)
+	upper = minKey(options.End, Successor(prefix))
+	if after != nil {
+		if options.Reverse {
+			upper = minKey(upper, after)
+		} else {
+			// The first key following after
+			lower = maxKey(lower, append(append([]byte{}, after...), 0))
+		}
+	}
+	return lower, upper, nil
+}
+
+// bounds returns the slice of keys within the bounds of options
+func bounds(keys [][]byte, options RangeOptions) (lo, hi int, err error) {
+	lower, upper, err := RangeBounds(options)
+	if err != nil {
+		return 0, 0, err
+	}
+	lo, hi = 0, len(keys)
+	if lower != nil {
+		lo = search(keys, lower)
+	}
+	if upper != nil {
+		hi = search(keys, upper)
+	}
+	if hi < lo {
+		hi = lo
+	}
+	return lo, hi, nil
+}
+
+func maxKey(a, b []byte) []byte {
+	if bytes.Compare(a, b) > 0 {
+		return a
+	}
+	return b
+}
+
+// minKey returns the smaller of two upper bounds, where nil is unbounded
+func minKey(a, b []byte) []byte {
+	if a == nil || (b != nil && bytes.Compare(b, a) < 0) {
+		return b
+	}
+	return a
+}
+
+// LiteralPrefix returns the part of a prefix or glob pattern, as accepted
+// by List, which all matching keys start with.
+func LiteralPrefix(pattern []byte) []byte {
+	if i := bytes.IndexAny(pattern, "*?[{\\"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// Successor returns the first key not having prefix,
+// or nil if there is none.
+func Successor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			k := make([]byte, i+1)
+			copy(k, prefix)
+			k[i]++
+			return k
+		}
+	}
+	return nil
+}
+
+// SortedKeys is a set of keys kept in ascending order, for stores which
+// can't iterate their keys in order. Range pages are served by seeking,
+// instead of sorting all keys for every page. SortedKeys is not safe for
+// concurrent use.
+type SortedKeys struct {
+	keys [][]byte
+}
+
+func (s *SortedKeys) Len() int {
+	return len(s.keys)
+}
+
+// Reset replaces all keys, which are sorted once.
+func (s *SortedKeys) Reset(keys [][]byte) {
+	SortKeys(keys)
+	s.keys = keys
+}
+
+func (s *SortedKeys) Insert(key []byte) {
+	i := search(s.keys, key)
+	if i < len(s.keys) && bytes.Equal(s.keys[i], key) {
+		return
+	}
+	k := make([]byte, len(key))
+	copy(k, key)
+	s.keys = append(s.keys, nil)
+	copy(s.keys[i+1:], s.keys[i:])
+	s.keys[i] = k
+}
+
+func (s *SortedKeys) Delete(key []byte) {
+	i := search(s.keys, key)
+	if i == len(s.keys) || !bytes.Equal(s.keys[i], key) {
+		return
+	}
+	copy(s.keys[i:], s.keys[i+1:])
+	s.keys[len(s.keys)-1] = nil
+	s.keys = s.keys[:len(s.keys)-1]
+}
+
+// Keys returns a copy of all keys.
+func (s *SortedKeys) Keys() [][]byte {
+	return append([][]byte(nil), s.keys...)
+}
+
+// Page selects the keys of a page of options, skipping keys include
+// rejects. more is set if the range continues after the page. Only the
+// keys of the page are visited, so stores may select a page while holding
+// their lock, and pass it to RangePage once released. The returned keys
+// must not be modified.
+func (s *SortedKeys) Page(options RangeOptions, include func(key []byte) bool) (keys [][]byte, more bool, err error) {
+	match, err := Matcher(options.Prefix)
+	if err != nil {
+		return nil, false, err
+	}
+
+	lo, hi, err := bounds(s.keys, options)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for n := 0; n < hi-lo; n++ {
+		i := lo + n
+		if options.Reverse {
+			i = hi - 1 - n
+		}
+		key := s.keys[i]
+		if !match(key) || (include != nil && !include(key)) {
+			continue
+		}
+		if options.Limit > 0 && len(keys) == options.Limit {
+			return keys, true, nil
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, false, nil
+}
+
+// RangePage calls fn for the keys of a page, as selected by
+// SortedKeys.Page, and returns the cursor of the next page. Keys for which
+// stat returns ErrNotFound have been removed since, and are skipped.
+func RangePage(ctx context.Context, keys [][]byte, more bool, stat func(key []byte) (Stat, error), fn func(key []byte, meta Stat) error) (string, error) {
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		meta, err := stat(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		if err := fn(key, meta); err != nil {
+			if errors.Is(err, ErrStopIter) {
+				return EncodeCursor(key), nil
+			}
+			return "", err
+		}
+	}
+
+	if more && len(keys) > 0 {
+		return EncodeCursor(keys[len(keys)-1]), nil
+	}
+	return "", nil
+}
+
+// search returns the index of the first key >= key
+func search(keys [][]byte, key []byte) int {
+	return sort.Search(len(keys), func(i int) bool {
+		return bytes.Compare(keys[i], key) >= 0
+	})
+}
+
+// EncodeCursor returns the cursor of a page ending at key. Stores
+// implementing RangeStore use it, so cursors are alike for all stores.
+func EncodeCursor(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// DecodeCursor returns the key a cursor continues after, or nil for an
+// empty cursor.
+func DecodeCursor(cursor string) ([]byte, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return key, nil
+}
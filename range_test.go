@@ -0,0 +1,66 @@
+package keyval
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSortedKeys(t *testing.T) {
+
+	var keys SortedKeys
+	for _, k := range []string{"c", "a/1", "b", "a-2", "b", "d"} {
+		keys.Insert([]byte(k))
+	}
+	keys.Delete([]byte("d"))
+	keys.Delete([]byte("missing"))
+
+	if keys.Len() != 4 {
+		t.Fatalf("expected 4 keys, got %d", keys.Len())
+	}
+
+	pages := func(options RangeOptions) string {
+		var pages []string
+		for {
+			page, more, err := keys.Page(options, func(key []byte) bool {
+				return string(key) != "c"
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			cursor, err := RangePage(context.Background(), page, more, func(key []byte) (Stat, error) {
+				return nil, nil
+			}, func(key []byte, meta Stat) error {
+				names = append(names, string(key))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages = append(pages, strings.Join(names, ","))
+			if cursor == "" {
+				return strings.Join(pages, "|")
+			}
+			options.Cursor = cursor
+		}
+	}
+
+	for _, test := range []struct {
+		options  RangeOptions
+		expected string
+	}{
+		{RangeOptions{}, "a-2,a/1,b"},
+		{RangeOptions{Limit: 2}, "a-2,a/1|b"},
+		{RangeOptions{Reverse: true, Limit: 2}, "b,a/1|a-2"},
+		{RangeOptions{Prefix: []byte("a")}, "a-2,a/1"},
+		{RangeOptions{Prefix: []byte("a/*")}, "a/1"},
+		{RangeOptions{Start: []byte("a/"), End: []byte("c")}, "a/1,b"},
+		{RangeOptions{Start: []byte("a/"), Reverse: true, Limit: 1}, "b|a/1"},
+	} {
+		if got := pages(test.options); got != test.expected {
+			t.Fatalf("expected %s for %+v, got %s", test.expected, test.options, got)
+		}
+	}
+}
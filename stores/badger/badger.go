@@ -0,0 +1,500 @@
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	system "github.com/kildevaeld/go-system"
+	"github.com/kildevaeld/keyval"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+)
+
+var (
+	_ keyval.KeyValStore     = (*store)(nil)
+	_ keyval.KeyValMetaStore = (*store)(nil)
+	_ keyval.TTLStore        = (*store)(nil)
+)
+
+const (
+	DefaultChunkSize      = 1 << 20
+	DefaultGCInterval     = 10 * time.Minute
+	DefaultGCDiscardRatio = 0.5
+)
+
+// Values are split into chunks, so they can be written and read without
+// holding them in memory. The record of a value is kept at metaPrefix+key,
+// its chunks at chunkPrefix+key+generation+index.
+const (
+	metaPrefix  = 'm'
+	chunkPrefix = 'c'
+)
+
+var sequenceKey = []byte("!generation")
+
+type BadgerOptions struct {
+	Path string `json:"path"`
+	// InMemory keeps all data in memory, Path is ignored
+	InMemory   bool `json:"in_memory,omitempty" mapstructure:"in_memory"`
+	SyncWrites bool `json:"sync_writes,omitempty" mapstructure:"sync_writes"`
+	ChunkSize  int  `json:"chunk_size,omitempty" mapstructure:"chunk_size"`
+	// GCInterval is how often the value log is garbage collected.
+	// It defaults to DefaultGCInterval, a negative interval disables it.
+	GCInterval     time.Duration `json:"gc_interval,omitempty" mapstructure:"gc_interval"`
+	GCDiscardRatio float64       `json:"gc_discard_ratio,omitempty" mapstructure:"gc_discard_ratio"`
+	Hash           string        `json:"hash,omitempty"`
+}
+
+type record struct {
+	Size       int64     `msgpack:"size"`
+	Hash       []byte    `msgpack:"hash"`
+	Ctime      time.Time `msgpack:"ctime"`
+	Mtime      time.Time `msgpack:"mtime"`
+	Generation uint64    `msgpack:"generation"`
+	Chunks     uint64    `msgpack:"chunks"`
+}
+
+type store struct {
+	db        *badger.DB
+	seq       *badger.Sequence
+	chunkSize int
+	hash      string
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func metaKey(key []byte) []byte {
+	return append([]byte{metaPrefix}, key...)
+}
+
+// chunkKey has a fixed length for a given key, so chunks of different
+// keys never collide.
+func chunkKey(key []byte, generation, index uint64) []byte {
+	k := make([]byte, 1+len(key)+16)
+	k[0] = chunkPrefix
+	copy(k[1:], key)
+	binary.BigEndian.PutUint64(k[1+len(key):], generation)
+	binary.BigEndian.PutUint64(k[1+len(key)+8:], index)
+	return k
+}
+
+func (s *store) Set(key []byte, reader io.Reader) error {
+	return s.SetWithTTL(key, reader, 0)
+}
+
+func (s *store) SetBytes(key []byte, bs []byte) error {
+	return s.SetWithTTL(key, bytes.NewReader(bs), 0)
+}
+
+func (s *store) SetBytesWithTTL(key []byte, bs []byte, ttl time.Duration) error {
+	return s.SetWithTTL(key, bytes.NewReader(bs), ttl)
+}
+
+// SetWithTTL writes the chunks of the value under a new generation,
+// before switching the record over to it. Chunks expire along with
+// the record.
+func (s *store) SetWithTTL(key []byte, reader io.Reader, ttl time.Duration) error {
+	if len(key) == 0 {
+		return keyval.ErrInvalidKey
+	}
+
+	generation, err := s.seq.Next()
+	if err != nil {
+		return err
+	}
+
+	hash, err := keyval.NewHash(s.hash)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	r := record{
+		Ctime:      now,
+		Mtime:      now,
+		Generation: generation,
+	}
+
+	wb := s.db.NewWriteBatch()
+	for {
+		buf := make([]byte, s.chunkSize)
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			if e := wb.SetEntry(entry(chunkKey(key, generation, r.Chunks), buf[:n], ttl)); e != nil {
+				wb.Cancel()
+				return e
+			}
+			r.Size += int64(n)
+			r.Chunks++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			wb.Cancel()
+			s.deleteChunks(key, generation, r.Chunks)
+			return err
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		s.deleteChunks(key, generation, r.Chunks)
+		return err
+	}
+	r.Hash = hash.Sum(nil)
+
+	var old *record
+	err = s.update(func(txn *badger.Txn) error {
+		var err error
+		if old, err = getRecord(txn, key); err == nil {
+			r.Ctime = old.Ctime
+		} else if !errors.Is(err, keyval.ErrNotFound) {
+			return err
+		}
+
+		bs, err := msgpack.Marshal(&r)
+		if err != nil {
+			return err
+		}
+		return txn.SetEntry(entry(metaKey(key), bs, ttl))
+	})
+	if err != nil {
+		s.deleteChunks(key, generation, r.Chunks)
+		return err
+	}
+
+	if old != nil {
+		return s.deleteChunks(key, old.Generation, old.Chunks)
+	}
+	return nil
+}
+
+func entry(key, value []byte, ttl time.Duration) *badger.Entry {
+	e := badger.NewEntry(key, value)
+	if ttl > 0 {
+		e = e.WithTTL(ttl)
+	}
+	return e
+}
+
+// update runs fn in a read-write transaction, retrying on conflicts.
+func (s *store) update(fn func(txn *badger.Txn) error) error {
+	for {
+		err := s.db.Update(fn)
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+}
+
+// deleteChunks removes the chunks of a replaced or removed value. Open
+// readers keep seeing them, as they read from a snapshot.
+func (s *store) deleteChunks(key []byte, generation, chunks uint64) error {
+	wb := s.db.NewWriteBatch()
+	for i := uint64(0); i < chunks; i++ {
+		if err := wb.Delete(chunkKey(key, generation, i)); err != nil {
+			wb.Cancel()
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+func (s *store) Has(key []byte) (bool, error) {
+	err := s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(metaKey(key))
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *store) Remove(key []byte) (bool, error) {
+	var old *record
+	err := s.update(func(txn *badger.Txn) error {
+		var err error
+		if old, err = getRecord(txn, key); err != nil {
+			return err
+		}
+		return txn.Delete(metaKey(key))
+	})
+	if errors.Is(err, keyval.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, s.deleteChunks(key, old.Generation, old.Chunks)
+}
+
+// Get streams the value chunk by chunk, from a snapshot taken when Get
+// is called. The snapshot is released when the reader is closed.
+func (s *store) Get(key []byte) (io.ReadCloser, error) {
+	txn := s.db.NewTransaction(false)
+	r, err := getRecord(txn, key)
+	if err != nil {
+		txn.Discard()
+		return nil, err
+	}
+	return &chunkReader{txn: txn, key: key, record: r}, nil
+}
+
+func (s *store) GetBytes(key []byte) ([]byte, error) {
+	reader, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *store) Stat(key []byte) (keyval.Stat, error) {
+	var stat keyval.Stat
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(metaKey(key))
+		if err == badger.ErrKeyNotFound {
+			return keyval.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		stat, err = itemStat(item)
+		return err
+	})
+	return stat, err
+}
+
+// List iterates records in key order, starting at prefix.
+func (s *store) List(prefix []byte, fn func(key []byte, meta keyval.Stat) error) error {
+	match, err := keyval.Matcher(prefix)
+	if err != nil {
+		return err
+	}
+
+	// Globs are matched within their literal prefix
+	prefix = keyval.LiteralPrefix(prefix)
+
+	return s.db.View(func(txn *badger.Txn) error {
+		options := badger.DefaultIteratorOptions
+		options.Prefix = metaKey(prefix)
+		it := txn.NewIterator(options)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.KeyCopy(nil)[1:]
+			if !match(key) {
+				continue
+			}
+			stat, err := itemStat(item)
+			if err != nil {
+				return err
+			}
+			if err := fn(key, stat); err != nil {
+				if errors.Is(err, keyval.ErrStopIter) {
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close stops the garbage collection and closes the database.
+func (s *store) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+			<-s.done
+		}
+		if e := s.seq.Release(); e != nil {
+			err = e
+		}
+		if e := s.db.Close(); e != nil {
+			err = e
+		}
+	})
+	return err
+}
+
+// runGC runs value log garbage collection every interval, until stopped.
+func (s *store) runGC(interval time.Duration, ratio float64) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			// Each successful run rewrites a single log file
+			var err error
+			for err == nil {
+				err = s.db.RunValueLogGC(ratio)
+			}
+			if err != badger.ErrNoRewrite && err != badger.ErrRejected {
+				zap.L().Sugar().Errorf("Could not garbage collect value log: %s", err)
+			}
+		}
+	}
+}
+
+func getRecord(txn *badger.Txn, key []byte) (*record, error) {
+	item, err := txn.Get(metaKey(key))
+	if err == badger.ErrKeyNotFound {
+		return nil, keyval.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var r record
+	err = item.Value(func(v []byte) error {
+		return msgpack.Unmarshal(v, &r)
+	})
+	return &r, err
+}
+
+func itemStat(item *badger.Item) (keyval.Stat, error) {
+	var r record
+	if err := item.Value(func(v []byte) error {
+		return msgpack.Unmarshal(v, &r)
+	}); err != nil {
+		return nil, err
+	}
+	var expires time.Time
+	if e := item.ExpiresAt(); e > 0 {
+		expires = time.Unix(int64(e), 0)
+	}
+	return keyval.NewStateExpires(r.Size, r.Hash, r.Ctime, r.Mtime, expires), nil
+}
+
+type chunkReader struct {
+	txn    *badger.Txn
+	key    []byte
+	record *record
+	index  uint64
+	buf    []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.index == c.record.Chunks {
+			return 0, io.EOF
+		}
+		item, err := c.txn.Get(chunkKey(c.key, c.record.Generation, c.index))
+		if err != nil {
+			return 0, err
+		}
+		if c.buf, err = item.ValueCopy(c.buf[:0]); err != nil {
+			return 0, err
+		}
+		c.index++
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkReader) Close() error {
+	c.txn.Discard()
+	return nil
+}
+
+// logger routes badger logging through zap
+type logger struct {
+	*zap.SugaredLogger
+}
+
+func (l logger) Warningf(format string, args ...interface{}) {
+	l.Warnf(format, args...)
+}
+
+func (l logger) Infof(format string, args ...interface{}) {
+	l.Debugf(format, args...)
+}
+
+func init() {
+	keyval.Register("badger", func(options interface{}) (keyval.KeyValStore, error) {
+		if options == nil {
+			return nil, fmt.Errorf("Badger store needs a path parameter")
+		}
+
+		var (
+			o  BadgerOptions
+			ok bool
+		)
+
+		if o, ok = options.(BadgerOptions); !ok {
+			if err := keyval.GetOptions(options, &o); err != nil {
+				return nil, err
+			}
+		}
+
+		if o.Path == "" && !o.InMemory {
+			return nil, errors.New("path cannot be empty")
+		}
+		if !keyval.ValidHash(o.Hash) {
+			return nil, fmt.Errorf("invalid hash algorithm: %s", o.Hash)
+		}
+		if o.ChunkSize <= 0 {
+			o.ChunkSize = DefaultChunkSize
+		}
+		if o.GCInterval == 0 {
+			o.GCInterval = DefaultGCInterval
+		}
+		if o.GCDiscardRatio <= 0 || o.GCDiscardRatio >= 1 {
+			o.GCDiscardRatio = DefaultGCDiscardRatio
+		}
+
+		if !o.InMemory {
+			o.Path = system.Environ(os.Environ()).Expand(o.Path)
+		} else {
+			o.Path = ""
+		}
+
+		db, err := badger.Open(badger.DefaultOptions(o.Path).
+			WithInMemory(o.InMemory).
+			WithSyncWrites(o.SyncWrites).
+			WithLogger(logger{zap.L().Sugar()}))
+		if err != nil {
+			return nil, err
+		}
+
+		seq, err := db.GetSequence(sequenceKey, 1000)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		s := &store{
+			db:        db,
+			seq:       seq,
+			chunkSize: o.ChunkSize,
+			hash:      o.Hash,
+		}
+
+		// The value log is only kept on disk
+		if o.GCInterval > 0 && !o.InMemory {
+			s.stop = make(chan struct{})
+			s.done = make(chan struct{})
+			go s.runGC(o.GCInterval, o.GCDiscardRatio)
+		}
+
+		return s, nil
+	})
+}
@@ -0,0 +1,162 @@
+package badger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/kildevaeld/keyval"
+)
+
+func newStore(t *testing.T, options map[string]interface{}) *store {
+	s, err := keyval.Store("badger", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*store)
+}
+
+// chunks counts the chunks stored for all values
+func chunks(t *testing.T, s *store) int {
+	count := 0
+	err := s.db.View(func(txn *badger.Txn) error {
+		options := badger.DefaultIteratorOptions
+		options.Prefix = []byte{chunkPrefix}
+		it := txn.NewIterator(options)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestSet(t *testing.T) {
+	s := newStore(t, map[string]interface{}{"in_memory": true, "chunk_size": 4})
+	defer s.Close()
+
+	value := []byte("a value spanning several chunks")
+	if err := s.Set([]byte("key"), bytes.NewReader(value)); err != nil {
+		t.Fatal(err)
+	}
+	if n := chunks(t, s); n != 8 {
+		t.Fatalf("expected 8 chunks, got %d", n)
+	}
+
+	stat, err := s.Stat([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != int64(len(value)) || len(stat.Hash()) == 0 {
+		t.Fatalf("unexpected stat: %d %x", stat.Size(), stat.Hash())
+	}
+
+	// Readers keep their snapshot while the value is replaced
+	reader, err := s.Get([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetBytes([]byte("key"), []byte("short")); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(bs, value) {
+		t.Fatalf("expected old value, got %q %v", bs, err)
+	}
+
+	if bs, _ := s.GetBytes([]byte("key")); string(bs) != "short" {
+		t.Fatalf("expected short, got %q", bs)
+	}
+	if n := chunks(t, s); n != 2 {
+		t.Fatalf("expected old chunks to be removed, got %d", n)
+	}
+
+	if removed, err := s.Remove([]byte("key")); err != nil || !removed {
+		t.Fatalf("expected key to be removed: %v", err)
+	}
+	if has, _ := s.Has([]byte("key")); has {
+		t.Fatal("expected key to be gone")
+	}
+	if n := chunks(t, s); n != 0 {
+		t.Fatalf("expected no chunks, got %d", n)
+	}
+	if _, err := s.Get([]byte("key")); err != keyval.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	s := newStore(t, map[string]interface{}{"in_memory": true})
+	defer s.Close()
+
+	if err := s.SetBytesWithTTL([]byte("key"), []byte("value"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := s.Stat([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Expires().IsZero() {
+		t.Fatal("expected expiry")
+	}
+
+	time.Sleep(2 * time.Second)
+
+	if has, _ := s.Has([]byte("key")); has {
+		t.Fatal("expected key to expire")
+	}
+}
+
+func TestList(t *testing.T) {
+	s := newStore(t, map[string]interface{}{"in_memory": true})
+	defer s.Close()
+
+	for _, k := range []string{"b/1", "a/2", "a/1", "c"} {
+		s.SetBytes([]byte(k), []byte(k))
+	}
+
+	var keys []string
+	err := s.List([]byte("a/"), func(key []byte, meta keyval.Stat) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "a/1,a/2" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyval-badger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newStore(t, map[string]interface{}{"path": dir, "gc_interval": "10ms"})
+	s.SetBytes([]byte("key"), []byte("value"))
+	time.Sleep(50 * time.Millisecond)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Values survive reopening
+	s = newStore(t, map[string]interface{}{"path": dir})
+	defer s.Close()
+	if bs, _ := s.GetBytes([]byte("key")); string(bs) != "value" {
+		t.Fatalf("expected value, got %q", bs)
+	}
+}
@@ -0,0 +1,293 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	system "github.com/kildevaeld/go-system"
+	"github.com/kildevaeld/keyval"
+	"github.com/vmihailenco/msgpack"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	_ keyval.KeyValStore     = (*store)(nil)
+	_ keyval.KeyValMetaStore = (*store)(nil)
+	_ keyval.RangeStore      = (*store)(nil)
+)
+
+// Sync modes
+const (
+	// SyncAlways syncs the database file on every write
+	SyncAlways = "always"
+	// SyncBatch coalesces concurrent writes into a single sync
+	SyncBatch = "batch"
+	// SyncNone never syncs, values may be lost on a crash
+	SyncNone = "none"
+)
+
+var (
+	dataBucket = []byte("data")
+	statBucket = []byte("stat")
+)
+
+type BoltOptions struct {
+	Path string `json:"path"`
+	// Bucket keeps the values, allowing several stores in one file
+	Bucket string `json:"bucket,omitempty"`
+	Sync   string `json:"sync,omitempty"`
+	// Timeout is how long to wait for the file lock, or 0 to wait forever
+	Timeout time.Duration `json:"timeout,omitempty"`
+	Hash    string        `json:"hash,omitempty"`
+}
+
+// record is the stat of a value. Records are kept in a bucket of their
+// own, so keys can be listed without reading any values.
+type record struct {
+	Size  int64     `msgpack:"size"`
+	Hash  []byte    `msgpack:"hash"`
+	Ctime time.Time `msgpack:"ctime"`
+	Mtime time.Time `msgpack:"mtime"`
+}
+
+func (r *record) stat() keyval.Stat {
+	return keyval.NewState(r.Size, r.Hash, r.Ctime, r.Mtime)
+}
+
+type store struct {
+	db     *bolt.DB
+	bucket []byte
+	sync   string
+	hash   string
+}
+
+// update runs fn in a write transaction, according to the sync mode.
+// fn may be run more than once in batch mode.
+func (s *store) update(fn func(data, stat *bolt.Bucket) error) error {
+	tx := func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		return fn(b.Bucket(dataBucket), b.Bucket(statBucket))
+	}
+	if s.sync == SyncBatch {
+		return s.db.Batch(tx)
+	}
+	return s.db.Update(tx)
+}
+
+func (s *store) view(fn func(data, stat *bolt.Bucket) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		return fn(b.Bucket(dataBucket), b.Bucket(statBucket))
+	})
+}
+
+func (s *store) Set(key []byte, reader io.Reader) error {
+	bs, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return s.SetBytes(key, bs)
+}
+
+func (s *store) SetBytes(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return keyval.ErrInvalidKey
+	}
+
+	hash, err := keyval.NewHash(s.hash)
+	if err != nil {
+		return err
+	}
+	hash.Write(value)
+
+	now := time.Now()
+	r := record{
+		Size:  int64(len(value)),
+		Hash:  hash.Sum(nil),
+		Ctime: now,
+		Mtime: now,
+	}
+
+	return s.update(func(data, stat *bolt.Bucket) error {
+		if old, err := getRecord(stat, key); err == nil {
+			r.Ctime = old.Ctime
+		} else if !errors.Is(err, keyval.ErrNotFound) {
+			return err
+		}
+
+		bs, err := msgpack.Marshal(&r)
+		if err != nil {
+			return err
+		}
+		if err := data.Put(key, value); err != nil {
+			return err
+		}
+		return stat.Put(key, bs)
+	})
+}
+
+func (s *store) Has(key []byte) (bool, error) {
+	var has bool
+	err := s.view(func(data, stat *bolt.Bucket) error {
+		has = stat.Get(key) != nil
+		return nil
+	})
+	return has, err
+}
+
+func (s *store) Remove(key []byte) (bool, error) {
+	var removed bool
+	err := s.update(func(data, stat *bolt.Bucket) error {
+		removed = stat.Get(key) != nil
+		if !removed {
+			return nil
+		}
+		if err := data.Delete(key); err != nil {
+			return err
+		}
+		return stat.Delete(key)
+	})
+	return removed, err
+}
+
+func (s *store) Get(key []byte) (io.ReadCloser, error) {
+	bs, err := s.GetBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(bs)), nil
+}
+
+func (s *store) GetBytes(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.view(func(data, stat *bolt.Bucket) error {
+		v := data.Get(key)
+		if v == nil {
+			return keyval.ErrNotFound
+		}
+		// Values are only valid during the transaction
+		value = make([]byte, len(v))
+		copy(value, v)
+		return nil
+	})
+	return value, err
+}
+
+func (s *store) Stat(key []byte) (keyval.Stat, error) {
+	var r *record
+	err := s.view(func(data, stat *bolt.Bucket) error {
+		var err error
+		r, err = getRecord(stat, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.stat(), nil
+}
+
+func (s *store) List(prefix []byte, fn func(key []byte, meta keyval.Stat) error) error {
+	_, err := s.Range(context.Background(), keyval.RangeOptions{Prefix: prefix}, fn)
+	return err
+}
+
+func (s *store) Close() error {
+	return s.db.Close()
+}
+
+func getRecord(stat *bolt.Bucket, key []byte) (*record, error) {
+	bs := stat.Get(key)
+	if bs == nil {
+		return nil, keyval.ErrNotFound
+	}
+	var r record
+	if err := decodeRecord(bs, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func decodeRecord(bs []byte, r *record) error {
+	return msgpack.Unmarshal(bs, r)
+}
+
+func validSync(mode string) bool {
+	switch mode {
+	case "", SyncAlways, SyncBatch, SyncNone:
+		return true
+	}
+	return false
+}
+
+func init() {
+	keyval.Register("bolt", func(options interface{}) (keyval.KeyValStore, error) {
+		if options == nil {
+			return nil, fmt.Errorf("Bolt store needs a path parameter")
+		}
+
+		var (
+			o  BoltOptions
+			ok bool
+		)
+
+		if o, ok = options.(BoltOptions); !ok {
+			if err := keyval.GetOptions(options, &o); err != nil {
+				return nil, err
+			}
+		}
+
+		if o.Path == "" {
+			return nil, errors.New("path cannot be empty")
+		}
+		if o.Bucket == "" {
+			o.Bucket = "keyval"
+		}
+		if !validSync(o.Sync) {
+			return nil, fmt.Errorf("invalid sync mode: %s", o.Sync)
+		}
+		if !keyval.ValidHash(o.Hash) {
+			return nil, fmt.Errorf("invalid hash algorithm: %s", o.Hash)
+		}
+
+		o.Path = system.Environ(os.Environ()).Expand(o.Path)
+
+		db, err := bolt.Open(o.Path, 0644, &bolt.Options{
+			Timeout: o.Timeout,
+			NoSync:  o.Sync == SyncNone,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		s := &store{
+			db:     db,
+			bucket: []byte(o.Bucket),
+			sync:   o.Sync,
+			hash:   o.Hash,
+		}
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(s.bucket)
+			if err != nil {
+				return err
+			}
+			if _, err := b.CreateBucketIfNotExists(dataBucket); err != nil {
+				return err
+			}
+			_, err = b.CreateBucketIfNotExists(statBucket)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		return s, nil
+	})
+}
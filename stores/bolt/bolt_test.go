@@ -0,0 +1,166 @@
+package bolt
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kildevaeld/keyval"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newStore(t *testing.T, options map[string]interface{}) (*store, func()) {
+	dir, err := ioutil.TempDir("", "keyval-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options["path"] = filepath.Join(dir, "store.db")
+
+	s, err := keyval.Store("bolt", options)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return s.(*store), func() {
+		s.(*store).Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSet(t *testing.T) {
+	s, done := newStore(t, map[string]interface{}{"sync": SyncBatch, "timeout": "1s"})
+	defer done()
+
+	if err := s.Set([]byte("key"), strings.NewReader("value")); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := s.GetBytes([]byte("key")); err != nil || string(bs) != "value" {
+		t.Fatalf("expected value, got %q %v", bs, err)
+	}
+
+	first, err := s.Stat([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Size() != 5 || len(first.Hash()) == 0 {
+		t.Fatalf("unexpected stat: %d %x", first.Size(), first.Hash())
+	}
+
+	s.SetBytes([]byte("key"), []byte("other"))
+	second, _ := s.Stat([]byte("key"))
+	if !second.Ctime().Equal(first.Ctime()) || string(second.Hash()) == string(first.Hash()) {
+		t.Fatal("expected ctime to be kept and hash to change")
+	}
+
+	if removed, err := s.Remove([]byte("key")); err != nil || !removed {
+		t.Fatalf("expected key to be removed: %v", err)
+	}
+	if has, _ := s.Has([]byte("key")); has {
+		t.Fatal("expected key to be gone")
+	}
+	if _, err := s.Get([]byte("key")); err != keyval.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.Stat([]byte("key")); err != keyval.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	s, done := newStore(t, map[string]interface{}{"bucket": "one"})
+	defer done()
+
+	s.SetBytes([]byte("key"), []byte("value"))
+
+	other := &store{db: s.db, bucket: []byte("two")}
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(other.bucket)
+		if err != nil {
+			return err
+		}
+		b.CreateBucket(dataBucket)
+		_, err = b.CreateBucket(statBucket)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, _ := other.Has([]byte("key")); has {
+		t.Fatal("expected buckets to be separate")
+	}
+}
+
+func TestRange(t *testing.T) {
+	s, done := newStore(t, map[string]interface{}{})
+	defer done()
+
+	for _, k := range []string{"a/1", "a/2", "a/3", "b/1", "c"} {
+		s.SetBytes([]byte(k), []byte(k))
+	}
+
+	collect := func(options keyval.RangeOptions) ([]string, string) {
+		var keys []string
+		cursor, err := s.Range(context.Background(), options, func(key []byte, meta keyval.Stat) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys, cursor
+	}
+
+	tests := []struct {
+		options  keyval.RangeOptions
+		expected string
+	}{
+		{keyval.RangeOptions{Prefix: []byte("a/")}, "a/1,a/2,a/3"},
+		{keyval.RangeOptions{Prefix: []byte("a/"), Reverse: true}, "a/3,a/2,a/1"},
+		{keyval.RangeOptions{Prefix: []byte("*/1")}, "a/1,b/1"},
+		{keyval.RangeOptions{Start: []byte("a/2"), End: []byte("b/1")}, "a/2,a/3"},
+		{keyval.RangeOptions{Start: []byte("a/2"), End: []byte("c"), Reverse: true}, "b/1,a/3,a/2"},
+	}
+	for _, test := range tests {
+		keys, _ := collect(test.options)
+		if strings.Join(keys, ",") != test.expected {
+			t.Fatalf("%+v: expected %s, got %v", test.options, test.expected, keys)
+		}
+	}
+
+	// Pages
+	for _, reverse := range []bool{false, true} {
+		var (
+			all    []string
+			cursor string
+		)
+		for {
+			keys, next := collect(keyval.RangeOptions{Limit: 2, Cursor: cursor, Reverse: reverse})
+			all = append(all, keys...)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		expected := "a/1,a/2,a/3,b/1,c"
+		if reverse {
+			expected = "c,b/1,a/3,a/2,a/1"
+		}
+		if strings.Join(all, ",") != expected {
+			t.Fatalf("expected %s, got %v", expected, all)
+		}
+	}
+
+	// List is ordered
+	var keys []string
+	s.List([]byte("a/"), func(key []byte, meta keyval.Stat) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if strings.Join(keys, ",") != "a/1,a/2,a/3" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
@@ -0,0 +1,105 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/kildevaeld/keyval"
+	bolt "go.etcd.io/bbolt"
+)
+
+type item struct {
+	key  []byte
+	stat keyval.Stat
+}
+
+// Range seeks directly to the first key in the range, and walks the
+// stat bucket in order. Items are collected before fn is called, so fn
+// is free to modify the store.
+func (s *store) Range(ctx context.Context, options keyval.RangeOptions, fn func(key []byte, meta keyval.Stat) error) (string, error) {
+	match, err := keyval.Matcher(options.Prefix)
+	if err != nil {
+		return "", err
+	}
+
+	lower, upper, err := keyval.RangeBounds(options)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		items []item
+		more  bool
+	)
+	err = s.view(func(data, stat *bolt.Bucket) error {
+		c := stat.Cursor()
+		var k, v []byte
+		if options.Reverse {
+			k, v = seekBefore(c, upper)
+		} else {
+			k, v = c.Seek(lower)
+		}
+
+		for ; k != nil; k, v = step(c, options.Reverse) {
+			if (options.Reverse && lower != nil && bytes.Compare(k, lower) < 0) ||
+				(!options.Reverse && upper != nil && bytes.Compare(k, upper) >= 0) {
+				break
+			}
+			if !match(k) {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if options.Limit > 0 && len(items) == options.Limit {
+				more = true
+				break
+			}
+
+			var r record
+			if err := decodeRecord(v, &r); err != nil {
+				return err
+			}
+			key := make([]byte, len(k))
+			copy(key, k)
+			items = append(items, item{key, r.stat()})
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, item := range items {
+		if err := fn(item.key, item.stat); err != nil {
+			if errors.Is(err, keyval.ErrStopIter) {
+				return keyval.EncodeCursor(item.key), nil
+			}
+			return "", err
+		}
+	}
+
+	if more {
+		return keyval.EncodeCursor(items[len(items)-1].key), nil
+	}
+	return "", nil
+}
+
+func step(c *bolt.Cursor, reverse bool) ([]byte, []byte) {
+	if reverse {
+		return c.Prev()
+	}
+	return c.Next()
+}
+
+// seekBefore positions c at the last key before key.
+func seekBefore(c *bolt.Cursor, key []byte) ([]byte, []byte) {
+	if key == nil {
+		return c.Last()
+	}
+	if k, _ := c.Seek(key); k == nil {
+		return c.Last()
+	}
+	return c.Prev()
+}
@@ -0,0 +1,164 @@
+package filesystem
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+)
+
+func (f *filesystem) Append(key []byte, reader io.Reader) error {
+	return f.AppendContext(context.Background(), key, reader)
+}
+
+func (f *filesystem) WriteAt(key []byte, offset int64, reader io.Reader) error {
+	return f.WriteAtContext(context.Background(), key, offset, reader)
+}
+
+func (f *filesystem) AppendContext(ctx context.Context, key []byte, reader io.Reader) error {
+	return f.writeAt(ctx, key, -1, reader)
+}
+
+func (f *filesystem) WriteAtContext(ctx context.Context, key []byte, offset int64, reader io.Reader) error {
+	if offset < 0 {
+		return keyval.ErrInvalidRange
+	}
+	return f.writeAt(ctx, key, offset, reader)
+}
+
+// writeAt writes reader into the file of key at offset, or at the end
+// if offset is negative. Missing values are created like by Set.
+func (f *filesystem) writeAt(ctx context.Context, key []byte, offset int64, reader io.Reader) error {
+	if err := f.ValidateKey(key); err != nil {
+		return err
+	}
+	if _, err := f.expire(key); err != nil {
+		return err
+	}
+
+	f.locks.Lock(key)
+	defer f.locks.Unlock(key)
+
+	// The request may have been cancelled while waiting for the lock
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	path := f.key(key)
+	s, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if offset > 0 {
+			return keyval.ErrInvalidRange
+		}
+		t, err := f.writeTemp(ctx, key, reader, time.Time{})
+		if err != nil {
+			return err
+		}
+		info, err := f.commit(key, t, nil)
+		if err != nil {
+			return err
+		}
+		return f.written(key, info, t.event)
+	} else if err != nil {
+		return err
+	} else if s.IsDir() {
+		return keyval.ErrInvalidKey
+	}
+
+	if offset > s.Size() {
+		return keyval.ErrInvalidRange
+	}
+
+	var file *os.File
+	if f.retention != nil {
+		// Versions may share their file with the value, so it is
+		// modified in a copy instead.
+		if file, err = copyTemp(ctx, path); err != nil {
+			return err
+		}
+	} else if file, err = os.OpenFile(path, os.O_WRONLY, 0); err != nil {
+		return err
+	}
+
+	if offset < 0 {
+		offset = s.Size()
+	}
+
+	_, werr := file.Seek(offset, io.SeekStart)
+	if werr == nil {
+		_, werr = io.Copy(file, keyval.NewContextReader(ctx, reader))
+	}
+
+	if f.retention != nil {
+		if werr != nil {
+			abortTemp(file)
+			return werr
+		}
+		if err := commitTemp(file, path); err != nil {
+			return err
+		}
+	} else {
+		if werr != nil && offset == s.Size() {
+			// Drop a partial append. Overwritten bytes cannot be restored,
+			// so the index is updated with whatever was written.
+			file.Truncate(s.Size())
+		}
+		err := file.Sync()
+		if e := file.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The hash covers the whole value, so it is computed again
+	info, err := f.infoFromFile(path)
+	if err != nil {
+		return err
+	}
+	if current, ok := f.index.Get(string(key)); ok {
+		info.ctime = current.ctime
+		info.expires = current.expires
+		info.meta = current.meta
+	}
+
+	if err := f.written(key, info, keyval.EventUpdated); err != nil {
+		return err
+	}
+	return werr
+}
+
+// written indexes and publishes a value written to key.
+// Callers must hold the key lock.
+func (f *filesystem) written(key []byte, info *Info, event keyval.EventType) error {
+	if err := f.index.Put(string(key), info); err != nil {
+		return err
+	}
+	if err := f.snapshot(key, info); err != nil {
+		return err
+	}
+	f.hub.Publish(event, key)
+	return nil
+}
+
+// copyTemp copies the file at path into a new temporary file.
+func copyTemp(ctx context.Context, path string) (*os.File, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	file, err := createTemp(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(file, keyval.NewContextReader(ctx, in)); err != nil {
+		abortTemp(file)
+		return nil, err
+	}
+	return file, nil
+}
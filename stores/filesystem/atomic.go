@@ -0,0 +1,119 @@
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// tempPrefix prefixes files which are still being written.
+const tempPrefix = ".kv-tmp-"
+
+func isTemp(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), tempPrefix)
+}
+
+// createTemp creates a temporary file in the same directory as path,
+// so it can be renamed into place atomically.
+func createTemp(path string) (*os.File, error) {
+	file, err := ioutil.TempFile(filepath.Dir(path), tempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// commitTemp flushes file to disk and renames it to path.
+// On failure the temporary file is removed and path is left untouched.
+func commitTemp(file *os.File, path string) error {
+	if err := file.Sync(); err != nil {
+		abortTemp(file)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// syncTemp flushes and closes file, leaving it in place.
+func syncTemp(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		abortTemp(file)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+func abortTemp(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	// Not all platforms support syncing directories
+	if err := dir.Sync(); err != nil && !os.IsPermission(err) {
+		zap.L().Sugar().Debugf("Could not sync directory %s: %s", path, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes bs to path, using a temporary file.
+func writeFileAtomic(path string, bs []byte) error {
+	file, err := createTemp(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(bs); err != nil {
+		abortTemp(file)
+		return err
+	}
+
+	return commitTemp(file, path)
+}
+
+// cleanTemp removes temporary files left behind by interrupted writes.
+func cleanTemp(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !isTemp(path) {
+			return nil
+		}
+		zap.L().Sugar().Debugf("Removing stale temporary file: %s", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,110 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+)
+
+type batch struct {
+	keyval.BatchOps
+	f *filesystem
+}
+
+// Commit writes all values to temporary files before moving any of them
+// into place, and persists the index once for the whole batch.
+func (b *batch) Commit() error {
+	ops := b.Ops
+	b.Ops = nil
+
+	temps := make([]*tempFile, len(ops))
+	abort := func() {
+		for _, t := range temps {
+			if t != nil {
+				abortTemp(t.file)
+			}
+		}
+	}
+
+	keys := make([][]byte, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+		switch op.Type {
+		case keyval.BatchPut:
+			t, err := b.f.writeTemp(context.Background(), op.Key, bytes.NewReader(op.Value), time.Time{})
+			if err != nil {
+				abort()
+				return err
+			}
+			temps[i] = t
+		case keyval.BatchDelete:
+			if err := b.f.ValidateKey(op.Key); err != nil {
+				abort()
+				return err
+			}
+		}
+	}
+
+	unlock := b.f.locks.LockAll(keys)
+	defer unlock()
+
+	changes := make(map[string]*Info)
+	events := make([]keyval.Event, 0, len(ops))
+	for i, op := range ops {
+		switch op.Type {
+		case keyval.BatchPut:
+			t := temps[i]
+			temps[i] = nil
+			info, err := b.f.commit(op.Key, t, nil)
+			if err != nil {
+				abort()
+				b.f.apply(changes, events)
+				return err
+			}
+			changes[string(op.Key)] = info
+			events = append(events, keyval.Event{Type: t.event, Key: op.Key})
+		case keyval.BatchDelete:
+			removed, err := b.f.removeFile(op.Key)
+			if err != nil {
+				abort()
+				b.f.apply(changes, events)
+				return err
+			}
+			changes[string(op.Key)] = nil
+			if removed {
+				events = append(events, keyval.Event{Type: keyval.EventDeleted, Key: op.Key})
+			}
+		}
+	}
+
+	if err := b.f.apply(changes, events); err != nil {
+		return err
+	}
+
+	for key, info := range changes {
+		if info != nil {
+			if err := b.f.snapshot([]byte(key), info); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// apply updates the index, and publishes events once it is persisted.
+func (f *filesystem) apply(changes map[string]*Info, events []keyval.Event) error {
+	if err := f.index.Apply(changes); err != nil {
+		return err
+	}
+	for _, e := range events {
+		f.hub.Publish(e.Type, e.Key)
+	}
+	return nil
+}
+
+func (f *filesystem) Batch() keyval.Batch {
+	return &batch{f: f}
+}
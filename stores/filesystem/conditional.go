@@ -0,0 +1,62 @@
+package filesystem
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+)
+
+func (f *filesystem) SetIfNotExists(key []byte, reader io.Reader) error {
+	return f.set(context.Background(), key, reader, time.Time{}, keyval.IfNotExists)
+}
+
+func (f *filesystem) SetIfMatch(key []byte, reader io.Reader, match []byte) error {
+	return f.set(context.Background(), key, reader, time.Time{}, keyval.IfMatch(match))
+}
+
+func (f *filesystem) DeleteIfMatch(key []byte, match []byte) error {
+	if err := f.ValidateKey(key); err != nil {
+		return err
+	}
+
+	f.locks.Lock(key)
+	defer f.locks.Unlock(key)
+
+	current, err := f.current(key)
+	if err != nil {
+		return err
+	}
+
+	if err := keyval.IfMatch(match)(current); err != nil {
+		return err
+	}
+
+	_, err = f.remove(key)
+	return err
+}
+
+// current returns the stat of the live value of key, or nil if there is
+// none. Callers must hold the key lock.
+func (f *filesystem) current(key []byte) (keyval.Stat, error) {
+	if info, ok := f.index.Get(string(key)); ok {
+		if keyval.Expired(info.expires, time.Now()) {
+			return nil, nil
+		}
+		return info, nil
+	}
+
+	// Values written behind the back of the store are not indexed
+	path := f.key(key)
+	if s, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	} else if s.IsDir() {
+		return nil, nil
+	}
+	return f.infoFromFile(path)
+}
@@ -2,27 +2,35 @@ package filesystem
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"crypto/sha512"
+	"context"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
 	system "github.com/kildevaeld/go-system"
 	"github.com/kildevaeld/keyval"
-	"github.com/vmihailenco/msgpack"
 )
 
 var (
 	metaKeyName = "__meta"
+	journalName = "__journal"
 )
 
+// isReserved reports whether rel is used by the store itself.
+func isReserved(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	return rel == metaKeyName || rel == metaKeyName+".log" || rel == journalName || isTemp(rel) ||
+		rel == versionsDir || strings.HasPrefix(rel, versionsDir+"/")
+}
+
 func hasParent(path string) bool {
 	parent := filepath.Dir(path)
 	return parent != "." && parent != "/"
@@ -31,12 +39,27 @@ func hasParent(path string) bool {
 type FileSystemOptions struct {
 	Path     string `json:"path"`
 	HashKeys string `json:"hash_keys,omitempty" mapstructure:"hash_keys"`
+	Hash     string `json:"hash,omitempty"`
+	// Versioning keeps old values, limited by Retention
+	Versioning bool             `json:"versioning,omitempty"`
+	Retention  keyval.Retention `json:"retention,omitempty"`
 }
 
 type filesystem struct {
 	path     string
 	hashKeys string
-	info     map[string]*Info
+	hash     string
+	index    *index
+	locks    keyLocks
+	// txLock serializes transaction commits, which share the journal
+	txLock sync.Mutex
+	// retention is set when versioning is enabled
+	retention *keyval.Retention
+	hub       keyval.Hub
+	// notify picks up external changes, while there are watchers
+	watchLock sync.Mutex
+	watchers  int
+	notify    *notifier
 }
 
 func (f *filesystem) mkDir(key string) error {
@@ -55,59 +78,295 @@ func (f *filesystem) mkDir(key string) error {
 }
 
 func (f *filesystem) Set(key []byte, reader io.Reader) error {
+	return f.SetContext(context.Background(), key, reader)
+}
 
-	str := f.key(key)
+func (f *filesystem) SetContext(ctx context.Context, key []byte, reader io.Reader) error {
+	return f.set(ctx, key, reader, time.Time{}, nil)
+}
 
-	if err := f.mkDir(str); err != nil {
+// set streams reader into a temporary file, and moves it into place
+// if cond accepts the current value.
+func (f *filesystem) set(ctx context.Context, key []byte, reader io.Reader, expires time.Time, cond keyval.Condition) error {
+	t, err := f.writeTemp(ctx, key, reader, expires)
+	if err != nil {
 		return err
 	}
+	return f.setTemp(key, t, cond)
+}
 
-	file, err := os.Create(str)
+func (f *filesystem) SetWithOptions(ctx context.Context, key []byte, reader io.Reader, options keyval.SetOptions) error {
+	var expires time.Time
+	if options.TTL > 0 {
+		expires = keyval.ExpiresAt(options.TTL)
+	}
+
+	t, err := f.writeTemp(ctx, key, reader, expires)
 	if err != nil {
 		return err
 	}
+	t.info.meta = options.Metadata.Copy()
+
+	return f.setTemp(key, t, options.Condition)
+}
 
-	_, err = io.Copy(file, reader)
+// setTemp moves t into place if cond accepts the current value.
+func (f *filesystem) setTemp(key []byte, t *tempFile, cond keyval.Condition) error {
+	f.locks.Lock(key)
+	defer f.locks.Unlock(key)
 
+	info, err := f.commit(key, t, cond)
 	if err != nil {
-		s, e := os.Stat(str)
-		if e != nil {
-			return e
-		}
-		return f.add(string(key), &Info{
-			size:  s.Size(),
-			ctime: s.ModTime(),
-			mtime: s.ModTime(),
-			hash:  nil,
-		})
+		return err
 	}
 
-	return err
+	return f.written(key, info, t.event)
+}
+
+// tempFile is a fully written value, waiting to be moved into place.
+type tempFile struct {
+	file *os.File
+	path string
+	info *Info
+	// event is set by commit
+	event keyval.EventType
+}
+
+func (f *filesystem) writeTemp(ctx context.Context, key []byte, reader io.Reader, expires time.Time) (*tempFile, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := f.ValidateKey(key); err != nil {
+		return nil, err
+	}
+
+	str := f.key(key)
+
+	if err := f.mkDir(str); err != nil {
+		return nil, err
+	}
+
+	file, err := createTemp(str)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := keyval.NewHash(f.hash)
+	if err != nil {
+		abortTemp(file)
+		return nil, err
+	}
+
+	if _, err = io.Copy(io.MultiWriter(file, hash), keyval.NewContextReader(ctx, reader)); err != nil {
+		abortTemp(file)
+		if e := ctx.Err(); e != nil {
+			return nil, e
+		}
+		return nil, err
+	}
+
+	s, err := file.Stat()
+	if err != nil {
+		abortTemp(file)
+		return nil, err
+	}
+
+	return &tempFile{file: file, path: str, info: &Info{
+		size:    s.Size(),
+		ctime:   s.ModTime(),
+		mtime:   s.ModTime(),
+		hash:    hash.Sum(nil),
+		expires: expires,
+	}}, nil
+}
+
+// commit moves t into place if cond accepts the current value, and
+// returns its index entry. Callers must hold the key lock.
+func (f *filesystem) commit(key []byte, t *tempFile, cond keyval.Condition) (*Info, error) {
+	current, err := f.current(key)
+	if err != nil {
+		abortTemp(t.file)
+		return nil, err
+	}
+
+	if cond != nil {
+		if err := cond(current); err != nil {
+			abortTemp(t.file)
+			return nil, err
+		}
+	}
+
+	if current == nil {
+		if err := f.writeKey(key, t.path); err != nil {
+			abortTemp(t.file)
+			return nil, err
+		}
+	}
+
+	if err := commitTemp(t.file, t.path); err != nil {
+		return nil, err
+	}
+
+	t.event = keyval.EventCreated
+	if current != nil {
+		t.info.ctime = current.Ctime()
+		t.event = keyval.EventUpdated
+	}
+
+	return t.info, nil
 }
 
 func (f *filesystem) SetBytes(key []byte, bs []byte) error {
-	return f.Set(key, bytes.NewReader(bs))
+	return f.SetContext(context.Background(), key, bytes.NewReader(bs))
 }
 
-func (f *filesystem) Has(bs []byte) bool {
-	_, err := os.Stat(f.key(bs))
-	return err != nil
+func (f *filesystem) SetBytesContext(ctx context.Context, key []byte, bs []byte) error {
+	return f.SetContext(ctx, key, bytes.NewReader(bs))
 }
 
-func (f *filesystem) Remove(key []byte) bool {
-	return os.Remove(f.key(key)) != nil
+func (f *filesystem) Has(key []byte) (bool, error) {
+	return f.HasContext(context.Background(), key)
+}
+
+func (f *filesystem) HasContext(ctx context.Context, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if err := f.ValidateKey(key); err != nil {
+		return false, err
+	}
+	if expired, err := f.expire(key); err != nil || expired {
+		return false, err
+	}
+	info, err := os.Stat(f.key(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return !info.IsDir(), nil
+}
+
+func (f *filesystem) Remove(key []byte) (bool, error) {
+	return f.RemoveContext(context.Background(), key)
+}
+
+func (f *filesystem) RemoveContext(ctx context.Context, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if err := f.ValidateKey(key); err != nil {
+		return false, err
+	}
+	if expired, err := f.expire(key); err != nil || expired {
+		return false, err
+	}
+
+	f.locks.Lock(key)
+	defer f.locks.Unlock(key)
+
+	return f.remove(key)
+}
+
+// remove removes the value of key. Callers must hold the key lock.
+func (f *filesystem) remove(key []byte) (bool, error) {
+	removed, err := f.removeFile(key)
+	if err != nil || !removed {
+		return removed, err
+	}
+	if err := f.index.Delete(string(key)); err != nil {
+		return true, err
+	}
+	f.hub.Publish(keyval.EventDeleted, key)
+	return true, nil
+}
+
+// removeFile is remove without updating the index.
+func (f *filesystem) removeFile(key []byte) (bool, error) {
+	path := f.key(key)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, f.removeKey(path)
 }
 
 func (f *filesystem) Get(key []byte) (io.ReadCloser, error) {
-	reader, err := os.Open(f.key(key))
+	return f.GetContext(context.Background(), key)
+}
+
+func (f *filesystem) GetContext(ctx context.Context, key []byte) (io.ReadCloser, error) {
+	reader, err := f.open(ctx, key)
 	if err != nil {
+		return nil, err
+	}
+	return &fileReader{keyval.NewContextReader(ctx, reader), reader}, nil
+}
+
+// GetRange reads part of a value, using ReadAt from offset.
+func (f *filesystem) GetRange(key []byte, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, keyval.ErrInvalidRange
+	}
+
+	file, err := f.open(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if offset > s.Size() {
+		file.Close()
+		return nil, keyval.ErrInvalidRange
+	}
+	if length < 0 || offset+length > s.Size() {
+		length = s.Size() - offset
+	}
+
+	return &fileReader{io.NewSectionReader(file, offset, length), file}, nil
+}
+
+func (f *filesystem) open(ctx context.Context, key []byte) (*os.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := f.ValidateKey(key); err != nil {
+		return nil, err
+	}
+	if expired, err := f.expire(key); err != nil {
+		return nil, err
+	} else if expired {
 		return nil, keyval.ErrNotFound
 	}
-	return reader, nil
+	file, err := os.Open(f.key(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, keyval.ErrNotFound
+		}
+		return nil, err
+	}
+	return file, nil
 }
 
 func (f *filesystem) GetBytes(key []byte) ([]byte, error) {
-	file, err := f.Get(key)
+	return f.GetBytesContext(context.Background(), key)
+}
+
+func (f *filesystem) GetBytesContext(ctx context.Context, key []byte) ([]byte, error) {
+	file, err := f.GetContext(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -116,10 +375,28 @@ func (f *filesystem) GetBytes(key []byte) ([]byte, error) {
 }
 
 func (f *filesystem) Stat(key []byte) (keyval.Stat, error) {
+	return f.StatContext(context.Background(), key)
+}
+
+func (f *filesystem) StatContext(ctx context.Context, key []byte) (keyval.Stat, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := f.ValidateKey(key); err != nil {
+		return nil, err
+	}
+
+	if expired, err := f.expire(key); err != nil {
+		return nil, err
+	} else if expired {
+		return nil, keyval.ErrNotFound
+	}
 
 	info, err := os.Stat(f.key(key))
 	if err != nil {
-		if err != os.ErrNotExist {
+		if os.IsNotExist(err) {
 			return nil, keyval.ErrNotFound
 		}
 		return nil, err
@@ -131,39 +408,116 @@ func (f *filesystem) Stat(key []byte) (keyval.Stat, error) {
 		}, nil
 	}
 
-	return f.info[string(key)], nil
+	if i, ok := f.index.Get(string(key)); ok {
+		return i, nil
+	}
+
+	return &Info{
+		size:  info.Size(),
+		ctime: info.ModTime(),
+		mtime: info.ModTime(),
+	}, nil
 }
-/*
+
 func (f *filesystem) List(prefix []byte, fn func(key []byte, meta keyval.Stat) error) error {
-	path := f.key(prefix)
-	files, err := filepath.Glob(string(path))
+	return f.ListContext(context.Background(), prefix, fn)
+}
+
+func (f *filesystem) ListContext(ctx context.Context, prefix []byte, fn func(key []byte, meta keyval.Stat) error) error {
+
+	match, err := keyval.Matcher(prefix)
 	if err != nil {
 		return err
 	}
 
-	for _, k := range files {
-		//f,e := os.Stat(filepath.Join(string(path), k))
+	err = f.walk(func(key string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !match([]byte(key)) {
+			return nil
+		}
+		stat, err := f.StatContext(ctx, []byte(key))
+		if err != nil {
+			if errors.Is(err, keyval.ErrNotFound) {
+				return nil
+			}
+			return err
+		}
+		return fn([]byte(key), stat)
+	})
+
+	if errors.Is(err, keyval.ErrStopIter) {
+		err = nil
 	}
 
-	return nil
-}*/
+	return err
+}
 
-func (f *filesystem) key(key []byte) string {
+// walk calls fn with the key of every value in the store. When keys are
+// hashed, the original key names are only known from the metadata.
+func (f *filesystem) walk(fn func(key string) error) error {
 	if f.hashKeys != "" {
-		var hash hash.Hash
-		switch f.hashKeys {
-		case "sha256":
-			hash = sha256.New()
-		case "sha512":
-			hash = sha512.New()
-		default:
-			panic(fmt.Sprintf("invalid algorithm: %s", f.hashKeys))
+		for _, k := range f.index.Keys() {
+			if err := fn(k); err != nil {
+				return err
+			}
 		}
+		return nil
+	}
 
-		return fmt.Sprintf("%s/%x", f.path, hash.Sum(key))
+	return f.walkFiles(fn)
+}
 
+// walkFiles calls fn with the relative path of every file in the store directory
+func (f *filesystem) walkFiles(fn func(key string) error) error {
+	return filepath.Walk(f.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(f.path, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if rel == versionsDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isReserved(rel) {
+			return nil
+		}
+		return fn(filepath.ToSlash(rel))
+	})
+}
+
+// ValidateKey rejects keys which could escape the store directory or
+// clash with files used by the store itself. Hashed keys never map onto
+// user controlled paths, so any non-empty key is valid.
+func (f *filesystem) ValidateKey(key []byte) error {
+	if len(key) == 0 {
+		return keyval.ErrInvalidKey
 	}
-	return filepath.Join(f.path, string(key))
+	if f.hashKeys != "" {
+		return nil
+	}
+	if err := keyval.ValidatePathKey(key); err != nil {
+		return err
+	}
+	if isReserved(string(key)) {
+		return keyval.ErrInvalidKey
+	}
+	return nil
+}
+
+func (f *filesystem) key(key []byte) string {
+	// The layout is validated in init, so this cannot fail
+	path, _ := f.layoutPath(f.layout(), key)
+	return path
 }
 
 func (f *filesystem) init() (*filesystem, error) {
@@ -176,6 +530,14 @@ func (f *filesystem) init() (*filesystem, error) {
 		f.path = path
 	}
 
+	if !keyval.ValidHash(f.hash) {
+		return nil, fmt.Errorf("invalid hash algorithm: %s", f.hash)
+	}
+
+	if !validHashKeys(f.hashKeys) {
+		return nil, fmt.Errorf("invalid hash_keys algorithm: %s", f.hashKeys)
+	}
+
 	if info, err := os.Stat(f.path); err == nil {
 		if !info.IsDir() {
 			return nil, fmt.Errorf("path '%s' already exists, and is not a directory", f.path)
@@ -186,40 +548,180 @@ func (f *filesystem) init() (*filesystem, error) {
 		return nil, err
 	}
 
-	f.load()
+	f.index = newIndex(filepath.Join(f.path, metaKeyName))
+
+	var layout string
+	if err := f.index.load(); err != nil {
+		if !os.IsNotExist(err) && !errors.Is(err, errCorruptIndex) {
+			return nil, err
+		}
+		zap.L().Sugar().Debugf("Rebuilding metadata index: %s", err)
+		f.index.SetHash(f.hashAlgorithm())
+		// Stores without an index keep their values in the plain layout.
+		// With hash_keys the index is rebuilt by migrate, which moves them
+		// into the hashed layout.
+		if f.hashKeys == "" {
+			if err := f.rebuild(); err != nil {
+				return nil, err
+			}
+		}
+		if err := f.index.SetLayout(layoutPlain); err != nil {
+			return nil, err
+		}
+		layout = layoutPlain
+	} else if layout = f.index.Layout(); layout == "" {
+		// Indexes written before layouts were recorded
+		if f.hashKeys == "" {
+			layout = layoutPlain
+		} else {
+			layout = layoutLegacy + f.hashKeys
+		}
+	}
+
+	// Temporary files belonging to a journaled transaction are needed
+	// to roll it forward, so recover before cleaning up.
+	if err := f.recover(); err != nil {
+		return nil, err
+	}
+
+	if err := cleanTemp(f.path); err != nil {
+		return nil, err
+	}
+
+	if layout != "" && layout != f.layout() {
+		if err := f.migrate(layout); err != nil {
+			return nil, err
+		}
+	}
+
+	if algorithm := f.index.Hash(); algorithm != f.hashAlgorithm() {
+		if err := f.rehash(algorithm); err != nil {
+			return nil, err
+		}
+	}
 
 	return f, nil
 }
 
-func (f *filesystem) load() error {
-	bs, err := ioutil.ReadFile(filepath.Join(f.path, metaKeyName))
-	if err != nil {
-		return nil
+func (f *filesystem) hashAlgorithm() string {
+	if f.hash == "" {
+		return keyval.DefaultHashAlgorithm
 	}
+	return f.hash
+}
 
-	if err := msgpack.Unmarshal(bs, &f.info); err != nil {
-		return nil
+// rehash computes the hashes of all values again, after the hash
+// algorithm was changed from the given one. Hashes of old versions
+// are left as they are.
+func (f *filesystem) rehash(from string) error {
+	if from == "" {
+		from = "unknown"
 	}
+	zap.L().Sugar().Infof("Rehashing %s from %s to %s", f.path, from, f.hashAlgorithm())
 
-	return nil
+	entries := make(map[string]*Info)
+	for _, key := range f.index.Keys() {
+		info, _ := f.index.Get(key)
+		current, err := f.infoFromFile(f.key([]byte(key)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		rehashed := *info
+		rehashed.hash = current.hash
+		entries[key] = &rehashed
+	}
+
+	f.index.SetHash(f.hashAlgorithm())
+	return f.index.Reset(entries)
 }
 
-func (f *filesystem) save() error {
-	var (
-		bs  []byte
-		err error
-	)
-	if bs, err = msgpack.Marshal(f.info); err != nil {
+// rebuild recreates the metadata index from the files on disk. Values in
+// the plain layout are found by their path. With hash_keys, values moved
+// into the hashed layout already are found by their key files.
+func (f *filesystem) rebuild() error {
+
+	entries := make(map[string]*Info)
+
+	add := func(key string, path string) error {
+		info, err := f.infoFromFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if old, ok := f.index.Get(key); ok {
+			info.ctime = old.ctime
+		}
+		entries[key] = info
+		return nil
+	}
+
+	hashed := make(map[string]bool)
+	if f.hashKeys != "" {
+		err := f.walkKeys(f.layout(), func(key []byte, path string) error {
+			hashed[path] = true
+			hashed[path+keySuffix] = true
+			return add(string(key), path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := f.walkFiles(func(key string) error {
+		path := filepath.Join(f.path, key)
+		if hashed[path] {
+			return nil
+		}
+		return add(key, path)
+	})
+	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(filepath.Join(f.path, metaKeyName), bs, 0666)
+	return f.index.Reset(entries)
+}
+
+func (f *filesystem) infoFromFile(path string) (*Info, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	s, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := keyval.NewHash(f.hash)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+
+	return &Info{
+		size:  s.Size(),
+		ctime: s.ModTime(),
+		mtime: s.ModTime(),
+		hash:  hash.Sum(nil),
+	}, nil
+}
 
+// Close closes the metadata log. The store can't be written afterwards.
+func (f *filesystem) Close() error {
+	return f.index.Close()
 }
 
-func (f *filesystem) add(p string, v *Info) error {
-	f.info[p] = v
-	return f.save()
+type fileReader struct {
+	io.Reader
+	io.Closer
 }
 
 func init() {
@@ -248,9 +750,17 @@ func init() {
 		f := &filesystem{
 			path:     o.Path,
 			hashKeys: o.HashKeys,
-			info:     make(map[string]*Info),
+			hash:     o.Hash,
 		}
 
-		return f.init()
+		if !o.Versioning {
+			return f.init()
+		}
+
+		f.retention = &o.Retention
+		if _, err := f.init(); err != nil {
+			return nil, err
+		}
+		return &versionedFS{f}, nil
 	})
 }
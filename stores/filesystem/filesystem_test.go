@@ -1,8 +1,25 @@
 package filesystem
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+	"github.com/vmihailenco/msgpack"
 )
 
 func TestHasParent(t *testing.T) {
@@ -31,3 +48,1195 @@ func TestSet(t *testing.T) {
 	}
 
 }
+
+func TestList(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_list",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_list")
+
+	for _, k := range []string{"a/b", "a/c", "x"} {
+		if err := fs.SetBytes([]byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := func(prefix string) int {
+		i := 0
+		if err := fs.List([]byte(prefix), func(key []byte, stat keyval.Stat) error {
+			i++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+
+	if c := count("a/"); c != 2 {
+		t.Fatalf("expected 2 keys with prefix, got %d", c)
+	}
+
+	if c := count("*"); c != 1 {
+		t.Fatalf("expected 1 key matching glob, got %d", c)
+	}
+
+	if c := count(""); c != 3 {
+		t.Fatalf("expected 3 keys, got %d", c)
+	}
+
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestSetAtomic(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_atomic",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_atomic")
+
+	if err := fs.SetBytes([]byte("key"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Set([]byte("key"), io.MultiReader(strings.NewReader("new"), failingReader{})); err == nil {
+		t.Fatal("expected write to fail")
+	}
+
+	bs, err := fs.GetBytes([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "old" {
+		t.Fatalf("expected old value, got %q", bs)
+	}
+
+	stale := filepath.Join(fs.path, tempPrefix+"stale")
+	if err := ioutil.WriteFile(stale, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&filesystem{path: "test_atomic"}).init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatal("expected stale temporary file to be removed")
+	}
+}
+
+func TestIndex(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_index",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_index")
+
+	if err := fs.SetBytes([]byte("dir/key"), []byte("Hello, World")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := sha256.Sum256([]byte("Hello, World"))
+
+	check := func(fs *filesystem) {
+		stat, err := fs.Stat([]byte("dir/key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size() != 12 {
+			t.Fatalf("expected size 12, got %d", stat.Size())
+		}
+		if !bytes.Equal(stat.Hash(), expected[:]) {
+			t.Fatalf("unexpected hash %x", stat.Hash())
+		}
+	}
+
+	check(fs)
+
+	if fs, err = (&filesystem{path: "test_index"}).init(); err != nil {
+		t.Fatal(err)
+	}
+	check(fs)
+
+	if err := ioutil.WriteFile(filepath.Join(fs.path, metaKeyName), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs, err = (&filesystem{path: "test_index"}).init(); err != nil {
+		t.Fatal(err)
+	}
+	check(fs)
+
+	if _, err := fs.Remove([]byte("dir/key")); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs, err = (&filesystem{path: "test_index"}).init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fs.index.Get("dir/key"); ok {
+		t.Fatal("expected removed key to be gone from the index")
+	}
+}
+
+func TestIndexLog(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_index_log",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_index_log")
+
+	snapshot, err := os.Stat(filepath.Join(fs.path, metaKeyName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := fs.SetBytes([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.Remove([]byte("key0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes are appended to the log, leaving the snapshot alone
+	if s, err := os.Stat(filepath.Join(fs.path, metaKeyName)); err != nil {
+		t.Fatal(err)
+	} else if s.Size() != snapshot.Size() || !s.ModTime().Equal(snapshot.ModTime()) {
+		t.Fatal("expected the snapshot to be left untouched")
+	}
+
+	// A record torn by a crash is dropped
+	log, err := os.OpenFile(filepath.Join(fs.path, metaKeyName+".log"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Write([]byte{0xff, 0xff, 0, 0, 1, 2})
+	log.Close()
+
+	check := func(fs *filesystem) {
+		keys := fs.index.Keys()
+		if len(keys) != 9 || keys[0] != "key1" {
+			t.Fatalf("unexpected keys %v", keys)
+		}
+	}
+
+	fs.Close()
+	if fs, err = (&filesystem{path: "test_index_log"}).init(); err != nil {
+		t.Fatal(err)
+	}
+	check(fs)
+
+	if err := fs.SetBytes([]byte("key1"), []byte("updated")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.index.compact(true); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := os.Stat(filepath.Join(fs.path, metaKeyName+".log")); err != nil {
+		t.Fatal(err)
+	} else if s.Size() != 0 {
+		t.Fatalf("expected compaction to empty the log, got %d bytes", s.Size())
+	}
+
+	fs.Close()
+	if fs, err = (&filesystem{path: "test_index_log"}).init(); err != nil {
+		t.Fatal(err)
+	}
+	check(fs)
+	if stat, err := fs.Stat([]byte("key1")); err != nil {
+		t.Fatal(err)
+	} else if stat.Size() != 7 {
+		t.Fatalf("expected the updated value to be indexed, got size %d", stat.Size())
+	}
+}
+
+func TestIndexCompaction(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_index_compaction",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_index_compaction")
+
+	// Compact whenever the log outgrows the snapshot
+	defer func(size int64) {
+		minCompactSize = size
+	}(minCompactSize)
+	minCompactSize = 0
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := []byte(fmt.Sprintf("key%d-%d", w, i))
+				if err := fs.SetBytes(key, []byte("value")); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%2 == 1 {
+					if _, err := fs.Remove(key); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := fs.index.SetLayout(layoutPlain); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	fs.Close()
+	if fs, err = (&filesystem{path: "test_index_compaction"}).init(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := fs.index.Keys(); len(keys) != 8*25 {
+		t.Fatalf("expected %d keys, got %d", 8*25, len(keys))
+	}
+}
+
+func TestHashAlgorithm(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_hash_algorithm",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_hash_algorithm")
+
+	if err := fs.SetBytes([]byte("key"), []byte("Hello, World")); err != nil {
+		t.Fatal(err)
+	}
+	if algorithm := fs.index.Hash(); algorithm != keyval.DefaultHashAlgorithm {
+		t.Fatalf("expected %s to be recorded, got %q", keyval.DefaultHashAlgorithm, algorithm)
+	}
+
+	// Changing the algorithm hashes existing values again
+	fs.Close()
+	if fs, err = (&filesystem{path: "test_hash_algorithm", hash: "sha512"}).init(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := sha512.Sum512([]byte("Hello, World"))
+	stat, err := fs.Stat([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stat.Hash(), expected[:]) {
+		t.Fatalf("expected sha512 hash, got %x", stat.Hash())
+	}
+
+	fs.Close()
+	if fs, err = (&filesystem{path: "test_hash_algorithm", hash: "sha512"}).init(); err != nil {
+		t.Fatal(err)
+	}
+	if algorithm := fs.index.Hash(); algorithm != "sha512" {
+		t.Fatalf("expected sha512 to be recorded, got %q", algorithm)
+	}
+}
+
+func TestHashKeys(t *testing.T) {
+
+	if _, err := (&filesystem{path: "test_hash", hashKeys: "md4"}).init(); err == nil {
+		t.Fatal("expected unknown algorithm to be rejected")
+	}
+
+	defer os.RemoveAll("test_hash")
+
+	fs, err := (&filesystem{path: "test_hash"}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.SetBytes([]byte("dir/key"), []byte("Hello, World")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening with hash_keys migrates the plain layout
+	if fs, err = (&filesystem{path: "test_hash", hashKeys: "sha256"}).init(); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("dir/key"))
+	name := hex.EncodeToString(sum[:])
+	expected := filepath.Join(fs.path, name[0:2], name[2:4], name)
+
+	if path := fs.key([]byte("dir/key")); path != expected {
+		t.Fatalf("expected %s, got %s", expected, path)
+	}
+
+	if _, err := os.Stat(expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(fs.path, "dir")); !os.IsNotExist(err) {
+		t.Fatal("expected plain directory to be removed")
+	}
+
+	bs, err := fs.GetBytes([]byte("dir/key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "Hello, World" {
+		t.Fatalf("unexpected value %q", bs)
+	}
+
+	keys := 0
+	if err := fs.List(nil, func(key []byte, stat keyval.Stat) error {
+		keys++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if keys != 1 {
+		t.Fatalf("expected 1 key, got %d", keys)
+	}
+
+	// Hashed keys are recovered from their key files, if the index is lost
+	fs.Close()
+	if err := ioutil.WriteFile(filepath.Join(fs.path, metaKeyName), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if fs, err = (&filesystem{path: "test_hash", hashKeys: "sha256"}).init(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := fs.index.Keys(); len(keys) != 1 || keys[0] != "dir/key" {
+		t.Fatalf("expected key to be recovered, got %v", keys)
+	}
+
+	if _, err := fs.Remove([]byte("dir/key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(expected + keySuffix); !os.IsNotExist(err) {
+		t.Fatal("expected key file to be removed along with the value")
+	}
+}
+
+func TestHashKeysWithoutIndex(t *testing.T) {
+
+	defer os.RemoveAll("test_hash_plain")
+
+	// Values written to the directory before the store was ever opened
+	for key, value := range map[string]string{"a": "Hello", "dir/b": "World"} {
+		path := filepath.Join("test_hash_plain", key)
+		if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs, err := (&filesystem{path: "test_hash_plain", hashKeys: "sha256"}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if layout := fs.index.Layout(); layout != fs.layout() {
+		t.Fatalf("expected %s layout, got %s", fs.layout(), layout)
+	}
+
+	for key, value := range map[string]string{"a": "Hello", "dir/b": "World"} {
+		sum := sha256.Sum256([]byte(key))
+		name := hex.EncodeToString(sum[:])
+		path := filepath.Join(fs.path, name[0:2], name[2:4], name)
+
+		if _, err := os.Stat(path + keySuffix); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(fs.path, key)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be moved", key)
+		}
+
+		bs, err := fs.GetBytes([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bs) != value {
+			t.Fatalf("unexpected value %q", bs)
+		}
+	}
+
+	var keys []string
+	if err := fs.List(nil, func(key []byte, stat keyval.Stat) error {
+		keys = append(keys, string(key))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "dir/b" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestTTL(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_ttl",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_ttl")
+
+	if err := fs.SetBytesWithTTL([]byte("key"), []byte("value"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	// Expiry must survive a restart
+	if fs, err = (&filesystem{path: "test_ttl"}).init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.GetBytes([]byte("key")); err != keyval.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if _, err := os.Stat(fs.key([]byte("key"))); !os.IsNotExist(err) {
+		t.Fatal("expected expired value to be removed from disk")
+	}
+}
+
+func TestConditional(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_conditional",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_conditional")
+
+	if err := fs.SetIfNotExists([]byte("key"), strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.SetIfNotExists([]byte("key"), strings.NewReader("second")); err != keyval.ErrExists {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+
+	stat, err := fs.Stat([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.SetIfMatch([]byte("key"), strings.NewReader("second"), stat.Hash()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.SetIfMatch([]byte("key"), strings.NewReader("third"), stat.Hash()); err != keyval.ErrConflict {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+
+	if err := fs.DeleteIfMatch([]byte("key"), stat.Hash()); err != keyval.ErrConflict {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+
+	bs, err := fs.GetBytes([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "second" {
+		t.Fatalf("unexpected value %q", bs)
+	}
+
+	if err := fs.DeleteIfMatch([]byte("key"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.DeleteIfMatch([]byte("key"), nil); err != keyval.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_batch",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_batch")
+
+	if err := fs.SetBytes([]byte("old"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := keyval.NewBatch(fs)
+	batch.Put([]byte("a"), []byte("a"))
+	batch.Put([]byte("dir/b"), []byte("b"))
+	batch.Delete([]byte("old"))
+
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, _ := fs.Has([]byte("old")); has {
+		t.Fatal("expected old to be deleted")
+	}
+
+	// The index must reflect the batch after a reload
+	fs, err = (&filesystem{
+		path: "test_batch",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "dir/b"} {
+		if _, ok := fs.index.Get(key); !ok {
+			t.Fatalf("expected %s in index", key)
+		}
+	}
+	if _, ok := fs.index.Get("old"); ok {
+		t.Fatal("expected old to be removed from index")
+	}
+
+	// Invalid keys fail the batch before anything is written
+	batch = fs.Batch()
+	batch.Put([]byte("c"), []byte("c"))
+	batch.Put([]byte("../escape"), []byte("x"))
+	if err := batch.Commit(); err != keyval.ErrInvalidKey {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+	if has, _ := fs.Has([]byte("c")); has {
+		t.Fatal("expected c not to be written")
+	}
+}
+
+func TestTransaction(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_tx",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_tx")
+
+	if err := fs.SetBytes([]byte("index"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := fs.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bs, err := tx.GetBytes([]byte("index")); err != nil || string(bs) != "1" {
+		t.Fatalf("expected 1, got %q (%v)", bs, err)
+	}
+	tx.SetBytes([]byte("index"), []byte("2"))
+	tx.SetBytes([]byte("data/2"), []byte("data"))
+
+	if bs, err := tx.GetBytes([]byte("index")); err != nil || string(bs) != "2" {
+		t.Fatalf("expected to read own write, got %q (%v)", bs, err)
+	}
+	if has, _ := fs.Has([]byte("data/2")); has {
+		t.Fatal("expected write to be invisible before commit")
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if bs, _ := fs.GetBytes([]byte("index")); string(bs) != "2" {
+		t.Fatalf("expected 2, got %q", bs)
+	}
+	if has, _ := fs.Has([]byte("data/2")); !has {
+		t.Fatal("expected data/2 after commit")
+	}
+	if _, err := os.Stat(filepath.Join(fs.path, journalName)); !os.IsNotExist(err) {
+		t.Fatal("expected journal to be removed")
+	}
+
+	// A concurrent change to a value read fails the commit
+	tx, _ = fs.Begin()
+	tx.GetBytes([]byte("index"))
+	tx.SetBytes([]byte("index"), []byte("3"))
+	fs.SetBytes([]byte("index"), []byte("other"))
+	if err := tx.Commit(); err != keyval.ErrConflict {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+
+	tx, _ = fs.Begin()
+	tx.Remove([]byte("index"))
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != keyval.ErrTxDone {
+		t.Fatalf("expected ErrTxDone, got %v", err)
+	}
+	if has, _ := fs.Has([]byte("index")); !has {
+		t.Fatal("expected rollback to keep index")
+	}
+}
+
+func TestTransactionRecovery(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_tx_recovery",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_tx_recovery")
+
+	fs.SetBytes([]byte("removed"), []byte("removed"))
+
+	// Simulate a commit interrupted after writing its journal
+	tf, err := fs.writeTemp(context.Background(), []byte("added"), strings.NewReader("added"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syncTemp(tf.file); err != nil {
+		t.Fatal(err)
+	}
+	temp, _ := filepath.Rel(fs.path, tf.file.Name())
+
+	bs, err := msgpack.Marshal(&journal{Entries: []journalEntry{
+		{Key: "added", Path: "added", Temp: temp, Info: tf.info},
+		{Key: "removed", Path: "removed"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(fs.path, journalName), bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// And one interrupted before, leaving only a temporary file
+	if _, err := fs.writeTemp(context.Background(), []byte("lost"), strings.NewReader("lost"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = (&filesystem{
+		path: "test_tx_recovery",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bs, err := fs.GetBytes([]byte("added")); err != nil || string(bs) != "added" {
+		t.Fatalf("expected added to be rolled forward, got %q (%v)", bs, err)
+	}
+	if _, ok := fs.index.Get("added"); !ok {
+		t.Fatal("expected added in index")
+	}
+	if has, _ := fs.Has([]byte("removed")); has {
+		t.Fatal("expected removed to be rolled forward")
+	}
+	if has, _ := fs.Has([]byte("lost")); has {
+		t.Fatal("expected lost to be rolled back")
+	}
+
+	files, _ := ioutil.ReadDir(fs.path)
+	for _, file := range files {
+		if isTemp(file.Name()) || file.Name() == journalName {
+			t.Fatalf("expected %s to be cleaned up", file.Name())
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_range",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_range")
+
+	// filepath.Walk visits a/1 before a-2, while a-2 sorts first
+	for _, k := range []string{"a/1", "a-2", "b"} {
+		fs.SetBytes([]byte(k), []byte(k))
+	}
+
+	var keys []string
+	cursor, err := fs.Range(context.Background(), keyval.RangeOptions{Limit: 2}, func(key []byte, stat keyval.Stat) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "a-2,a/1" {
+		t.Fatalf("unexpected order: %v", keys)
+	}
+
+	keys = nil
+	cursor, err = fs.Range(context.Background(), keyval.RangeOptions{Limit: 2, Cursor: cursor}, func(key []byte, stat keyval.Stat) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "b" || cursor != "" {
+		t.Fatalf("unexpected second page: %v (%s)", keys, cursor)
+	}
+
+	hashed, err := (&filesystem{
+		path:     "test_range_hashed",
+		hashKeys: "sha256",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_range_hashed")
+
+	for _, k := range []string{"a/1", "a-2", "b"} {
+		hashed.SetBytes([]byte(k), []byte(k))
+	}
+
+	for _, store := range []*filesystem{fs, hashed} {
+		for _, test := range []struct {
+			options  keyval.RangeOptions
+			expected []string
+		}{
+			{keyval.RangeOptions{Reverse: true, Limit: 2}, []string{"b,a/1", "a-2"}},
+			{keyval.RangeOptions{Prefix: []byte("a/")}, []string{"a/1"}},
+			{keyval.RangeOptions{Prefix: []byte("a*")}, []string{"a-2"}},
+			{keyval.RangeOptions{Start: []byte("a/"), End: []byte("b")}, []string{"a/1"}},
+			{keyval.RangeOptions{Start: []byte("a/"), Reverse: true, Limit: 1}, []string{"b", "a/1"}},
+		} {
+			var pages []string
+			options := test.options
+			for {
+				keys = nil
+				cursor, err := store.Range(context.Background(), options, func(key []byte, stat keyval.Stat) error {
+					keys = append(keys, string(key))
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				pages = append(pages, strings.Join(keys, ","))
+				if cursor == "" {
+					break
+				}
+				options.Cursor = cursor
+			}
+			if strings.Join(pages, "|") != strings.Join(test.expected, "|") {
+				t.Fatalf("unexpected pages for %+v: %v", test.options, pages)
+			}
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_watch",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_watch")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := fs.Watch(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(typ keyval.EventType, key string) {
+		select {
+		case e := <-events:
+			if e.Type != typ || string(e.Key) != key {
+				t.Fatalf("expected %s %s, got %s %s", typ, key, e.Type, e.Key)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %s %s", typ, key)
+		}
+	}
+
+	// Writes through the store are only reported once
+	fs.SetBytes([]byte("own"), []byte("1"))
+	next(keyval.EventCreated, "own")
+
+	// External changes are picked up, also in new directories
+	if err := os.MkdirAll(filepath.Join(fs.path, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	// Written in place, the file is seen as created and then written,
+	// which is reported once
+	file, err := os.Create(filepath.Join(fs.path, "dir", "external"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("x"))
+	time.Sleep(10 * time.Millisecond)
+	file.Write([]byte("y"))
+	file.Close()
+	next(keyval.EventCreated, "dir/external")
+
+	stat, err := fs.Stat([]byte("dir/external"))
+	if err != nil || len(stat.Hash()) == 0 || stat.Size() != 2 {
+		t.Fatalf("expected external value to be indexed, got %v", err)
+	}
+
+	fs.Remove([]byte("own"))
+	next(keyval.EventDeleted, "own")
+
+	if err := os.Remove(filepath.Join(fs.path, "dir", "external")); err != nil {
+		t.Fatal(err)
+	}
+	next(keyval.EventDeleted, "dir/external")
+
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %s %s", e.Type, e.Key)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestVersioning(t *testing.T) {
+
+	store, err := keyval.Store("filesystem", FileSystemOptions{
+		Path:       "test_versions",
+		Versioning: true,
+		Retention:  keyval.Retention{Keep: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_versions")
+
+	if keyval.Versioned(store, keyval.Retention{}) != store {
+		t.Fatal("expected native versioning")
+	}
+	vs := store.(keyval.VersionedStore)
+
+	for _, value := range []string{"1", "2", "3"} {
+		if err := store.SetBytes([]byte("dir/key"), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := vs.Versions([]byte("dir/key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions, got %d", len(versions))
+	}
+
+	read := func(id string) string {
+		r, err := vs.GetVersion([]byte("dir/key"), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		bs, _ := ioutil.ReadAll(r)
+		return string(bs)
+	}
+
+	if v := read(versions[0].ID); v != "3" {
+		t.Fatalf("expected newest version to be 3, got %s", v)
+	}
+	if v := read(versions[1].ID); v != "2" {
+		t.Fatalf("expected oldest version to be 2, got %s", v)
+	}
+
+	// Versions share files with values, which must not leak into listings
+	var keys []string
+	store.(keyval.KeyValMetaStore).List(nil, func(key []byte, stat keyval.Stat) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if strings.Join(keys, ",") != "dir/key" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	if removed, _ := store.Remove([]byte("dir/key")); !removed {
+		t.Fatal("expected key to be removed")
+	}
+	if v := read(versions[1].ID); v != "2" {
+		t.Fatalf("expected versions to survive removal, got %s", v)
+	}
+
+	if err := vs.Restore([]byte("dir/key"), versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := store.GetBytes([]byte("dir/key")); string(bs) != "2" {
+		t.Fatalf("expected restored value 2, got %s", bs)
+	}
+
+	if _, err := vs.GetVersion([]byte("dir/key"), "../../key"); err != keyval.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := store.SetBytes([]byte("__versions/dir/key.v/x"), nil); err != keyval.ErrInvalidKey {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestVersionedWrapper(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_versioned_wrapper",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_versioned_wrapper")
+
+	// Without native versioning, the store is wrapped
+	store := keyval.Versioned(fs, keyval.Retention{Keep: 2})
+	vs := store.(keyval.VersionedStore)
+
+	for _, value := range []string{"1", "2", "3"} {
+		if err := store.SetBytes([]byte("dir/key"), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := vs.Versions([]byte("dir/key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+
+	if err := vs.Restore([]byte("dir/key"), versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := store.GetBytes([]byte("dir/key")); string(bs) != "2" {
+		t.Fatalf("expected restored value 2, got %s", bs)
+	}
+
+	var keys []string
+	store.(keyval.KeyValMetaStore).List(nil, func(key []byte, stat keyval.Stat) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if strings.Join(keys, ",") != "dir/key" {
+		t.Fatalf("expected versions to be hidden, got %v", keys)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_metadata",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_metadata")
+
+	meta := keyval.Metadata{
+		keyval.MetaContentType: "text/plain",
+		keyval.MetaFilename:    "hello.txt",
+		"owner":                "me",
+	}
+
+	if err := fs.SetWithOptions(context.Background(), []byte("key"), strings.NewReader("hello"), keyval.SetOptions{Metadata: meta}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Metadata is persisted in the index
+	fs, err = (&filesystem{
+		path: "test_metadata",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := fs.Stat([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stat.Metadata(), meta) {
+		t.Fatalf("expected %v, got %v", meta, stat.Metadata())
+	}
+
+	// Plain writes replace the metadata along with the value
+	fs.SetBytes([]byte("key"), []byte("bye"))
+	if stat, _ := fs.Stat([]byte("key")); stat.Metadata() != nil {
+		t.Fatalf("expected no metadata, got %v", stat.Metadata())
+	}
+}
+
+func TestGetRange(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path: "test_get_range",
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_get_range")
+
+	fs.SetBytes([]byte("key"), []byte("0123456789"))
+
+	reader, err := fs.GetRange([]byte("key"), 4, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(bs) != "456" {
+		t.Fatalf("expected 456, got %q", bs)
+	}
+
+	reader, err = fs.GetRange([]byte("key"), 8, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, _ = ioutil.ReadAll(reader)
+	reader.Close()
+	if string(bs) != "89" {
+		t.Fatalf("expected 89, got %q", bs)
+	}
+
+	if _, err := fs.GetRange([]byte("key"), 11, 1); err != keyval.ErrInvalidRange {
+		t.Fatalf("expected ErrInvalidRange, got %v", err)
+	}
+	if _, err := fs.GetRange([]byte("missing"), 0, 1); err != keyval.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestAppend(t *testing.T) {
+
+	fs, err := (&filesystem{
+		path:      "test_append",
+		retention: &keyval.Retention{Keep: 5},
+	}).init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll("test_append")
+
+	if err := fs.Append([]byte("log"), strings.NewReader("one\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Append([]byte("log"), strings.NewReader("two\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteAt([]byte("log"), 0, strings.NewReader("ONE")); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, _ := fs.GetBytes([]byte("log"))
+	if string(bs) != "ONE\ntwo\n" {
+		t.Fatalf("unexpected value %q", bs)
+	}
+
+	stat, err := fs.Stat([]byte("log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(bs)
+	if stat.Size() != int64(len(bs)) || !bytes.Equal(stat.Hash(), hash[:]) {
+		t.Fatalf("stat not updated: %d %x", stat.Size(), stat.Hash())
+	}
+
+	// Earlier versions are left untouched by in-place writes
+	versions, err := (&versionedFS{fs}).Versions([]byte("log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 versions, got %d", len(versions))
+	}
+	reader, err := (&versionedFS{fs}).GetVersion([]byte("log"), versions[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, _ = ioutil.ReadAll(reader)
+	reader.Close()
+	if string(bs) != "one\n" {
+		t.Fatalf("expected first version, got %q", bs)
+	}
+
+	if err := fs.WriteAt([]byte("log"), 100, strings.NewReader("x")); err != keyval.ErrInvalidRange {
+		t.Fatalf("expected ErrInvalidRange, got %v", err)
+	}
+
+	// Without versioning the file is written in place
+	fs.retention = nil
+	if err := fs.Append([]byte("log"), strings.NewReader("three\n")); err != nil {
+		t.Fatal(err)
+	}
+	bs, _ = fs.GetBytes([]byte("log"))
+	stat, _ = fs.Stat([]byte("log"))
+	if string(bs) != "ONE\ntwo\nthree\n" || stat.Size() != int64(len(bs)) {
+		t.Fatalf("unexpected value %q (%d)", bs, stat.Size())
+	}
+
+	// A cancelled append leaves the value untouched
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := keyval.AppendContext(ctx, fs, []byte("log"), strings.NewReader("four\n")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	fs.retention = &keyval.Retention{Keep: 5}
+	if err := fs.AppendContext(ctx, []byte("log"), strings.NewReader("four\n")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if bs, _ = fs.GetBytes([]byte("log")); string(bs) != "ONE\ntwo\nthree\n" {
+		t.Fatalf("unexpected value %q after cancelled append", bs)
+	}
+}
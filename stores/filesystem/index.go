@@ -0,0 +1,442 @@
+package filesystem
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+)
+
+const indexVersion = 1
+
+// minCompactSize is the size the log may grow to, before it is compacted
+// into a snapshot regardless of the size of the snapshot. It is a variable
+// so tests can compact small logs.
+var minCompactSize int64 = 1 << 20
+
+var errCorruptIndex = errors.New("corrupt metadata index")
+
+type indexFile struct {
+	Version int    `msgpack:"version"`
+	Layout  string `msgpack:"layout"`
+	// Hash is the algorithm of the value hashes
+	Hash string `msgpack:"hash"`
+	// Generation identifies the log the snapshot was compacted with.
+	// Log records of other generations are already part of it.
+	Generation uint64           `msgpack:"generation"`
+	Entries    map[string]*Info `msgpack:"entries"`
+}
+
+// logRecord is a set of changes appended to the log at once.
+// A nil info deletes the entry.
+type logRecord struct {
+	Generation uint64           `msgpack:"generation"`
+	Changes    map[string]*Info `msgpack:"changes"`
+}
+
+// index keeps the metadata of all values in the store. A snapshot of
+// the index is kept at path, and changes are appended to a log at
+// path+".log" and synced. Once the log has grown larger than the
+// snapshot, it is compacted into a new snapshot, so every change costs
+// a constant amount of work on average.
+type index struct {
+	path    string
+	lock    sync.RWMutex
+	layout  string
+	hash    string
+	entries map[string]*Info
+	// keys holds the keys of entries in order, for Range
+	keys keyval.SortedKeys
+
+	// logLock orders appends to the log, and guards the log and the
+	// sizes and generation below. compactLock is held shared while
+	// appending and syncing, and exclusively while compacting, so
+	// appends only wait for each other while writing. The generation
+	// only changes while compactLock is held exclusively, so appends
+	// may read it holding compactLock alone.
+	logLock      sync.Mutex
+	compactLock  sync.RWMutex
+	log          *os.File
+	logSize      int64
+	snapshotSize int64
+	generation   uint64
+}
+
+func newIndex(path string) *index {
+	return &index{
+		path:    path,
+		entries: make(map[string]*Info),
+	}
+}
+
+func (i *index) logPath() string {
+	return i.path + ".log"
+}
+
+// load reads the snapshot and replays the log. It returns os.ErrNotExist
+// if no snapshot has been written yet, and errCorruptIndex if it cannot
+// be decoded. The log is opened in any case, so the index can be reset.
+func (i *index) load() error {
+	log, err := os.OpenFile(i.logPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	i.log = log
+
+	bs, err := ioutil.ReadFile(i.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return os.ErrNotExist
+		}
+		return err
+	}
+
+	file, err := decodeIndex(bs)
+	if err != nil {
+		return errCorruptIndex
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.layout = file.Layout
+	i.hash = file.Hash
+	i.entries = file.Entries
+	i.generation = file.Generation
+	i.snapshotSize = int64(len(bs))
+
+	if err := i.replay(); err != nil {
+		return err
+	}
+	i.sortKeys()
+	return nil
+}
+
+// sortKeys rebuilds the sorted keys from the entries. Callers must hold
+// the write lock.
+func (i *index) sortKeys() {
+	keys := make([][]byte, 0, len(i.entries))
+	for k := range i.entries {
+		keys = append(keys, []byte(k))
+	}
+	i.keys.Reset(keys)
+}
+
+func decodeIndex(bs []byte) (file *indexFile, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			file, err = nil, errCorruptIndex
+		}
+	}()
+
+	file = &indexFile{}
+	if err = msgpack.Unmarshal(bs, file); err == nil && file.Version == indexVersion {
+		if file.Entries == nil {
+			file.Entries = make(map[string]*Info)
+		}
+		return file, nil
+	}
+
+	// Fall back to the legacy format, which was a plain map
+	entries := make(map[string]*Info)
+	if err = msgpack.Unmarshal(bs, &entries); err != nil {
+		return nil, err
+	}
+
+	for k, v := range entries {
+		if v == nil {
+			delete(entries, k)
+		}
+	}
+
+	return &indexFile{Entries: entries}, nil
+}
+
+// replay applies the records of the current generation in the log.
+// A record torn by a crash ends the log, and is truncated. Callers must
+// hold the write lock.
+func (i *index) replay() error {
+	bs, err := ioutil.ReadFile(i.logPath())
+	if err != nil {
+		return err
+	}
+
+	var offset int
+	for offset < len(bs) {
+		record, n := decodeRecord(bs[offset:])
+		if n == 0 {
+			zap.L().Sugar().Warnf("Truncating metadata log %s at a torn record", i.logPath())
+			if err := i.log.Truncate(int64(offset)); err != nil {
+				return err
+			}
+			break
+		}
+		offset += n
+
+		if record.Generation != i.generation {
+			continue
+		}
+		for key, info := range record.Changes {
+			if info == nil {
+				delete(i.entries, key)
+			} else {
+				i.entries[key] = info
+			}
+		}
+	}
+
+	i.logSize = int64(offset)
+	return nil
+}
+
+// encodeRecord frames a record with its length and checksum.
+func encodeRecord(record *logRecord) ([]byte, error) {
+	payload, err := msgpack.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	bs := make([]byte, 8+len(payload))
+	binary.LittleEndian.PutUint32(bs[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(bs[4:8], crc32.ChecksumIEEE(payload))
+	copy(bs[8:], payload)
+	return bs, nil
+}
+
+// decodeRecord decodes the record at the start of bs, and returns the
+// number of bytes it takes up, or 0 if it is incomplete or damaged.
+func decodeRecord(bs []byte) (record *logRecord, n int) {
+	defer func() {
+		if r := recover(); r != nil {
+			record, n = nil, 0
+		}
+	}()
+
+	if len(bs) < 8 {
+		return nil, 0
+	}
+	size := int(binary.LittleEndian.Uint32(bs[0:4]))
+	if size > len(bs)-8 {
+		return nil, 0
+	}
+	payload := bs[8 : 8+size]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(bs[4:8]) {
+		return nil, 0
+	}
+
+	record = &logRecord{}
+	if err := msgpack.Unmarshal(payload, record); err != nil {
+		return nil, 0
+	}
+	return record, 8 + size
+}
+
+// append logs changes and applies them. The entries are updated while
+// holding the log lock, so they change in the order they are logged.
+func (i *index) append(changes map[string]*Info) error {
+	i.compactLock.RLock()
+
+	bs, err := encodeRecord(&logRecord{Generation: i.generation, Changes: changes})
+	if err != nil {
+		i.compactLock.RUnlock()
+		return err
+	}
+
+	i.logLock.Lock()
+	if _, err = i.log.Write(bs); err != nil {
+		// Drop a partial record, so later records can be replayed
+		i.log.Truncate(i.logSize)
+	} else {
+		i.logSize += int64(len(bs))
+		i.lock.Lock()
+		for key, info := range changes {
+			if info == nil {
+				delete(i.entries, key)
+				i.keys.Delete([]byte(key))
+			} else {
+				i.entries[key] = info
+				i.keys.Insert([]byte(key))
+			}
+		}
+		i.lock.Unlock()
+	}
+	i.logLock.Unlock()
+
+	if err == nil {
+		err = i.log.Sync()
+	}
+	i.compactLock.RUnlock()
+
+	if err != nil {
+		return err
+	}
+	return i.compact(false)
+}
+
+// compact writes a new snapshot, once the log has grown larger than the
+// current one, or always if force is set.
+func (i *index) compact(force bool) error {
+	if !force && !i.needsCompaction() {
+		return nil
+	}
+
+	i.compactLock.Lock()
+	defer i.compactLock.Unlock()
+
+	// Another writer may have compacted the log while waiting
+	if !force && !i.needsCompaction() {
+		return nil
+	}
+
+	return i.save()
+}
+
+func (i *index) needsCompaction() bool {
+	i.logLock.Lock()
+	defer i.logLock.Unlock()
+	return i.logSize > minCompactSize && i.logSize > i.snapshotSize
+}
+
+// save writes a snapshot of a new generation and empties the log. If the
+// log can't be emptied, its records are ignored as they belong to the
+// previous generation. Callers must hold compactLock exclusively.
+func (i *index) save() error {
+	i.logLock.Lock()
+	defer i.logLock.Unlock()
+
+	generation := uint64(time.Now().UnixNano())
+	if generation <= i.generation {
+		generation = i.generation + 1
+	}
+
+	i.lock.RLock()
+	bs, err := msgpack.Marshal(&indexFile{
+		Version:    indexVersion,
+		Layout:     i.layout,
+		Hash:       i.hash,
+		Generation: generation,
+		Entries:    i.entries,
+	})
+	i.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(i.path, bs); err != nil {
+		return err
+	}
+	i.generation = generation
+	i.snapshotSize = int64(len(bs))
+
+	if err := i.log.Truncate(0); err != nil {
+		return err
+	}
+	i.logSize = 0
+	return i.log.Sync()
+}
+
+func (i *index) Get(key string) (*Info, bool) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	info, ok := i.entries[key]
+	return info, ok
+}
+
+func (i *index) Put(key string, info *Info) error {
+	return i.append(map[string]*Info{key: info})
+}
+
+func (i *index) Delete(key string) error {
+	if _, ok := i.Get(key); !ok {
+		return nil
+	}
+	return i.append(map[string]*Info{key: nil})
+}
+
+// Apply updates several entries with a single log record.
+// A nil info deletes the entry.
+func (i *index) Apply(changes map[string]*Info) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	return i.append(changes)
+}
+
+// Reset replaces all entries and writes a snapshot.
+func (i *index) Reset(entries map[string]*Info) error {
+	i.compactLock.Lock()
+	defer i.compactLock.Unlock()
+
+	i.lock.Lock()
+	i.entries = entries
+	i.sortKeys()
+	i.lock.Unlock()
+
+	return i.save()
+}
+
+// Layout returns the layout the index was written with, or an empty
+// string if it is unknown.
+func (i *index) Layout() string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.layout
+}
+
+func (i *index) SetLayout(layout string) error {
+	i.compactLock.Lock()
+	defer i.compactLock.Unlock()
+
+	i.lock.Lock()
+	i.layout = layout
+	i.lock.Unlock()
+
+	return i.save()
+}
+
+// Hash returns the algorithm the hashes in the index were computed with,
+// or an empty string if it is unknown.
+func (i *index) Hash() string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.hash
+}
+
+// SetHash sets the hash algorithm, which is persisted with the next
+// snapshot. It is meant to be followed by Reset.
+func (i *index) SetHash(algorithm string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.hash = algorithm
+}
+
+// Keys returns all keys in sorted order.
+func (i *index) Keys() []string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	keys := make([]string, 0, i.keys.Len())
+	for _, k := range i.keys.Keys() {
+		keys = append(keys, string(k))
+	}
+	return keys
+}
+
+// Page selects a page of keys, see keyval.SortedKeys.
+func (i *index) Page(options keyval.RangeOptions) ([][]byte, bool, error) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.keys.Page(options, nil)
+}
+
+func (i *index) Close() error {
+	if i.log == nil {
+		return nil
+	}
+	return i.log.Close()
+}
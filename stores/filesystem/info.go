@@ -9,11 +9,13 @@ import (
 )
 
 type Info struct {
-	size  int64
-	hash  []byte
-	ctime time.Time
-	mtime time.Time
-	isDir bool
+	size    int64
+	hash    []byte
+	ctime   time.Time
+	mtime   time.Time
+	isDir   bool
+	expires time.Time
+	meta    keyval.Metadata
 }
 
 func (s *Info) Size() int64 {
@@ -31,14 +33,27 @@ func (s *Info) Hash() []byte {
 func (s *Info) IsDir() bool {
 	return s.isDir
 }
+func (s *Info) Expires() time.Time {
+	return s.expires
+}
+func (s *Info) Metadata() keyval.Metadata {
+	return s.meta
+}
 
 func (s *Info) MarshalMsgpack() ([]byte, error) {
-	return msgpack.Marshal(dict.Map{
+	m := dict.Map{
 		"size":  s.size,
 		"hash":  s.hash,
 		"ctime": s.ctime,
 		"mtime": s.mtime,
-	})
+	}
+	if !s.expires.IsZero() {
+		m["expires"] = s.expires
+	}
+	if len(s.meta) > 0 {
+		m["meta"] = map[string]string(s.meta)
+	}
+	return msgpack.Marshal(m)
 }
 
 func (s *Info) UnmarshalMsgpack(bs []byte) error {
@@ -46,15 +61,69 @@ func (s *Info) UnmarshalMsgpack(bs []byte) error {
 	if err := msgpack.Unmarshal(bs, &m); err != nil {
 		return err
 	}
-	s.ctime = m.Get("ctime").(time.Time)
-	s.mtime = m.Get("mtime").(time.Time)
-	s.size = m.Get("size").(int64)
-	s.hash = m.Get("hash").([]byte)
+	s.ctime = toTime(m.Get("ctime"))
+	s.mtime = toTime(m.Get("mtime"))
+	s.size = toInt64(m.Get("size"))
+	s.hash, _ = m.Get("hash").([]byte)
+	s.expires = toTime(m.Get("expires"))
+	s.meta = toMetadata(m.Get("meta"))
 	return nil
 }
 
+func toMetadata(v interface{}) keyval.Metadata {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		return nil
+	}
+	meta := make(keyval.Metadata, len(m))
+	for k, v := range m {
+		if s, ok := v.(string); ok {
+			meta[k] = s
+		}
+	}
+	return meta
+}
+
+// toTime handles both representations msgpack decodes time extensions
+// into, depending on how deeply the value is nested.
+func toTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case time.Time:
+		return t
+	case *time.Time:
+		if t != nil {
+			return *t
+		}
+	}
+	return time.Time{}
+}
+
+func toInt64(v interface{}) int64 {
+	switch t := v.(type) {
+	case int64:
+		return t
+	case uint64:
+		return int64(t)
+	case int:
+		return int64(t)
+	case int32:
+		return int64(t)
+	case uint32:
+		return int64(t)
+	case int16:
+		return int64(t)
+	case uint16:
+		return int64(t)
+	case int8:
+		return int64(t)
+	case uint8:
+		return int64(t)
+	}
+	return 0
+}
+
 func NewState(s int64, h []byte, c time.Time, m time.Time, d bool) keyval.Stat {
 	return &Info{
-		s, h, c, m, d,
+		s, h, c, m, d, time.Time{}, nil,
 	}
 }
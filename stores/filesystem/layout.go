@@ -0,0 +1,214 @@
+package filesystem
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kildevaeld/keyval"
+	"go.uber.org/zap"
+)
+
+// Layouts describe how keys are mapped onto paths in the store directory.
+//
+//	plain            <root>/<key>
+//	hashed:<algo>    <root>/ab/cd/abcd...  (hex digest of the key)
+//	legacy:<algo>    <root>/<hex(key + digest of nothing)>
+//
+// The legacy layout is what hash_keys produced in earlier versions,
+// it is only supported as a migration source.
+//
+// In the hashed layout each value has a key file next to it, named by
+// adding keySuffix, which keeps the original key. The index can be
+// rebuilt from the key files.
+const (
+	layoutPlain  = "plain"
+	layoutHashed = "hashed:"
+	layoutLegacy = "legacy:"
+
+	keySuffix = ".key"
+)
+
+func (f *filesystem) layout() string {
+	if f.hashKeys == "" {
+		return layoutPlain
+	}
+	return layoutHashed + f.hashKeys
+}
+
+// layoutPath returns the path of key in the given layout
+func (f *filesystem) layoutPath(layout string, key []byte) (string, error) {
+	switch {
+	case layout == layoutPlain:
+		return filepath.Join(f.path, string(key)), nil
+	case strings.HasPrefix(layout, layoutHashed):
+		hash, err := keyval.NewHash(strings.TrimPrefix(layout, layoutHashed))
+		if err != nil {
+			return "", err
+		}
+		hash.Write(key)
+		name := hex.EncodeToString(hash.Sum(nil))
+		return filepath.Join(f.path, name[0:2], name[2:4], name), nil
+	case strings.HasPrefix(layout, layoutLegacy):
+		hash, err := keyval.NewHash(strings.TrimPrefix(layout, layoutLegacy))
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(f.path, fmt.Sprintf("%x", hash.Sum(key))), nil
+	}
+	return "", fmt.Errorf("unknown layout: %s", layout)
+}
+
+// writeKey records key next to the value at path, if keys are hashed.
+func (f *filesystem) writeKey(key []byte, path string) error {
+	if f.hashKeys == "" {
+		return nil
+	}
+	return writeFileAtomic(path+keySuffix, key)
+}
+
+// removeKey removes the key file of the value at path, if keys are
+// hashed. In other layouts the file may be a value of its own.
+func (f *filesystem) removeKey(path string) error {
+	if f.hashKeys == "" {
+		return nil
+	}
+	return removeKeyFile(path)
+}
+
+func removeKeyFile(path string) error {
+	if err := os.Remove(path + keySuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// walkKeys calls fn with the key and path of every value stored in the
+// given hashed layout, as recorded by their key files.
+func (f *filesystem) walkKeys(layout string, fn func(key []byte, path string) error) error {
+	return filepath.Walk(f.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if rel, _ := filepath.Rel(f.path, path); rel == versionsDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, keySuffix) || isTemp(path) {
+			return nil
+		}
+		key, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		value, err := f.layoutPath(layout, key)
+		if err != nil {
+			return err
+		}
+		// Left behind by a layout using another algorithm
+		if value+keySuffix != path {
+			return nil
+		}
+		return fn(key, value)
+	})
+}
+
+func validHashKeys(algorithm string) bool {
+	return algorithm == "" || (algorithm != "xxhash" && keyval.ValidHash(algorithm))
+}
+
+// migrate moves every value from the from layout into the configured one.
+// Values already moved by an interrupted migration are left where they are,
+// so migrate can safely be run again.
+func (f *filesystem) migrate(from string) error {
+
+	to := f.layout()
+
+	zap.L().Sugar().Infof("Migrating %s from %s to %s layout", f.path, from, to)
+
+	if from == layoutPlain {
+		// Files written before the index existed are only known from disk
+		if err := f.rebuild(); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range f.index.Keys() {
+		src, err := f.layoutPath(from, []byte(key))
+		if err != nil {
+			return err
+		}
+		dst, err := f.layoutPath(to, []byte(key))
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(src); err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			if _, err := os.Stat(dst); err == nil {
+				// Moved by an interrupted migration
+				if strings.HasPrefix(from, layoutHashed) {
+					if err := removeKeyFile(src); err != nil {
+						return err
+					}
+				}
+				if err := f.moveVersions(src, dst); err != nil {
+					return err
+				}
+				continue
+			}
+			zap.L().Sugar().Warnf("Value for %s is missing, dropping it from the index", key)
+			if err := f.index.Delete(key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := f.mkDir(dst); err != nil {
+			return err
+		}
+
+		if err := f.writeKey([]byte(key), dst); err != nil {
+			return err
+		}
+
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(from, layoutHashed) {
+			if err := removeKeyFile(src); err != nil {
+				return err
+			}
+		}
+
+		if err := f.moveVersions(src, dst); err != nil {
+			return err
+		}
+
+		if from == layoutPlain {
+			removeEmptyParents(f.path, src)
+		}
+	}
+
+	return f.index.SetLayout(to)
+}
+
+// removeEmptyParents removes the empty directories between path and root
+func removeEmptyParents(root, path string) {
+	for dir := filepath.Dir(path); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package filesystem
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// keyLocks serializes changes to the same key. Keys are spread over
+// a fixed number of mutexes, so unrelated keys may share a lock.
+type keyLocks [64]sync.Mutex
+
+func (k *keyLocks) slot(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(len(k)))
+}
+
+func (k *keyLocks) get(key []byte) *sync.Mutex {
+	return &k[k.slot(key)]
+}
+
+func (k *keyLocks) Lock(key []byte) {
+	k.get(key).Lock()
+}
+
+func (k *keyLocks) Unlock(key []byte) {
+	k.get(key).Unlock()
+}
+
+// LockAll locks all keys at once, and returns a function unlocking them.
+// Locks are taken in a fixed order, so concurrent callers can't deadlock.
+func (k *keyLocks) LockAll(keys [][]byte) func() {
+	seen := make(map[int]bool)
+	var slots []int
+	for _, key := range keys {
+		if i := k.slot(key); !seen[i] {
+			seen[i] = true
+			slots = append(slots, i)
+		}
+	}
+	sort.Ints(slots)
+	for _, i := range slots {
+		k[i].Lock()
+	}
+	return func() {
+		for _, i := range slots {
+			k[i].Unlock()
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kildevaeld/keyval"
+)
+
+// errPageFull ends the walk of a page
+var errPageFull = errors.New("page full")
+
+// Range selects a page of keys, and stats them once selected, so fn is
+// free to modify the store. When keys are hashed, the page is selected
+// from the sorted keys of the index. Otherwise the directory is walked in
+// key order, reading only the directories the page lies in.
+func (f *filesystem) Range(ctx context.Context, options keyval.RangeOptions, fn func(key []byte, meta keyval.Stat) error) (string, error) {
+	var (
+		keys [][]byte
+		more bool
+		err  error
+	)
+	if f.hashKeys != "" {
+		keys, more, err = f.index.Page(options)
+	} else {
+		keys, more, err = f.pageFiles(ctx, options)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return keyval.RangePage(ctx, keys, more, func(key []byte) (keyval.Stat, error) {
+		return f.StatContext(ctx, key)
+	}, fn)
+}
+
+type dirEntry struct {
+	// key is the key of a file, or the prefix of the keys in a directory
+	key   string
+	isDir bool
+}
+
+// pageFiles walks the store directory in key order. The keys below a
+// directory all start with its name and a slash, so sorting the entries
+// of every directory on that name yields the keys in order, and whole
+// directories outside the bounds can be skipped.
+func (f *filesystem) pageFiles(ctx context.Context, options keyval.RangeOptions) ([][]byte, bool, error) {
+	match, err := keyval.Matcher(options.Prefix)
+	if err != nil {
+		return nil, false, err
+	}
+
+	lower, upper, err := keyval.RangeBounds(options)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var (
+		keys [][]byte
+		more bool
+	)
+
+	// below and above report whether all keys of an entry lie outside
+	// the bounds
+	below := func(e dirEntry) bool {
+		if lower == nil {
+			return false
+		}
+		if e.isDir {
+			return !bytes.HasPrefix(lower, []byte(e.key)) && e.key < string(lower)
+		}
+		return e.key < string(lower)
+	}
+	above := func(e dirEntry) bool {
+		return upper != nil && e.key >= string(upper)
+	}
+
+	var visit func(dir, prefix string) error
+	visit = func(dir, prefix string) error {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		entries := make([]dirEntry, 0, len(infos))
+		for _, info := range infos {
+			e := dirEntry{key: prefix + info.Name(), isDir: info.IsDir()}
+			if isReserved(e.key) {
+				continue
+			}
+			if e.isDir {
+				e.key += "/"
+			}
+			entries = append(entries, e)
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			if options.Reverse {
+				return entries[i].key > entries[j].key
+			}
+			return entries[i].key < entries[j].key
+		})
+
+		for _, e := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if options.Reverse {
+				if below(e) {
+					return errPageFull
+				} else if above(e) {
+					continue
+				}
+			} else {
+				if above(e) {
+					return errPageFull
+				} else if below(e) {
+					continue
+				}
+			}
+
+			if e.isDir {
+				if err := visit(filepath.Join(dir, filepath.Base(e.key)), e.key); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if !match([]byte(e.key)) {
+				continue
+			}
+			if options.Limit > 0 && len(keys) == options.Limit {
+				more = true
+				return errPageFull
+			}
+			keys = append(keys, []byte(e.key))
+		}
+		return nil
+	}
+
+	if err := visit(f.path, ""); err != nil && err != errPageFull {
+		return nil, false, err
+	}
+
+	return keys, more, nil
+}
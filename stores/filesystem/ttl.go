@@ -0,0 +1,60 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+)
+
+func (f *filesystem) SetWithTTL(key []byte, reader io.Reader, ttl time.Duration) error {
+	return f.set(context.Background(), key, reader, keyval.ExpiresAt(ttl), nil)
+}
+
+func (f *filesystem) SetBytesWithTTL(key []byte, bs []byte, ttl time.Duration) error {
+	return f.SetWithTTL(key, bytes.NewReader(bs), ttl)
+}
+
+// expire removes key, if it has expired.
+func (f *filesystem) expire(key []byte) (bool, error) {
+	if info, ok := f.index.Get(string(key)); !ok || !keyval.Expired(info.expires, time.Now()) {
+		return false, nil
+	}
+
+	f.locks.Lock(key)
+	defer f.locks.Unlock(key)
+
+	// The value may have been replaced while waiting for the lock
+	info, ok := f.index.Get(string(key))
+	if !ok || !keyval.Expired(info.expires, time.Now()) {
+		return false, nil
+	}
+	path := f.key(key)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	if err := f.removeKey(path); err != nil {
+		return true, err
+	}
+	if err := f.index.Delete(string(key)); err != nil {
+		return true, err
+	}
+	f.hub.Publish(keyval.EventDeleted, key)
+	return true, nil
+}
+
+func (f *filesystem) RemoveExpired() (int, error) {
+	count := 0
+	for _, key := range f.index.Keys() {
+		expired, err := f.expire([]byte(key))
+		if err != nil {
+			return count, err
+		} else if expired {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,367 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+)
+
+type txRead struct {
+	value  []byte
+	hash   []byte
+	exists bool
+}
+
+type txWrite struct {
+	value  []byte
+	remove bool
+}
+
+// tx buffers writes in memory. On Commit the values are written to
+// temporary files, and a journal describing how to move them into place
+// is persisted before any of them are renamed. An interrupted commit is
+// rolled forward on start if the journal was written, and rolled back
+// otherwise.
+type tx struct {
+	f      *filesystem
+	reads  map[string]*txRead
+	writes map[string]*txWrite
+	done   bool
+}
+
+func (f *filesystem) Begin() (keyval.Tx, error) {
+	return &tx{
+		f:      f,
+		reads:  make(map[string]*txRead),
+		writes: make(map[string]*txWrite),
+	}, nil
+}
+
+// get returns the value of key as seen by the transaction, or nil.
+func (t *tx) get(key []byte) ([]byte, error) {
+	if t.done {
+		return nil, keyval.ErrTxDone
+	}
+	if err := t.f.ValidateKey(key); err != nil {
+		return nil, err
+	}
+	if w, ok := t.writes[string(key)]; ok {
+		if w.remove {
+			return nil, nil
+		}
+		return w.value, nil
+	}
+	if r, ok := t.reads[string(key)]; ok {
+		if !r.exists {
+			return nil, nil
+		}
+		return r.value, nil
+	}
+
+	r, err := t.read(key)
+	if err != nil {
+		return nil, err
+	}
+	t.reads[string(key)] = r
+	if !r.exists {
+		return nil, nil
+	}
+	return r.value, nil
+}
+
+// read loads key from the store, holding the key lock so that the value
+// matches its hash.
+func (t *tx) read(key []byte) (*txRead, error) {
+	t.f.locks.Lock(key)
+	defer t.f.locks.Unlock(key)
+
+	current, err := t.f.current(key)
+	if err != nil {
+		return nil, err
+	} else if current == nil {
+		return &txRead{}, nil
+	}
+
+	bs, err := ioutil.ReadFile(t.f.key(key))
+	if err != nil {
+		return nil, err
+	}
+	return &txRead{value: bs, hash: current.Hash(), exists: true}, nil
+}
+
+func (t *tx) set(key []byte, value []byte) error {
+	if t.done {
+		return keyval.ErrTxDone
+	}
+	if err := t.f.ValidateKey(key); err != nil {
+		return err
+	}
+	t.writes[string(key)] = &txWrite{value: value}
+	return nil
+}
+
+func (t *tx) Set(key []byte, reader io.Reader) error {
+	bs, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return t.set(key, bs)
+}
+
+func (t *tx) SetBytes(key []byte, bs []byte) error {
+	value := make([]byte, len(bs))
+	copy(value, bs)
+	return t.set(key, value)
+}
+
+func (t *tx) Has(key []byte) (bool, error) {
+	value, err := t.get(key)
+	return value != nil, err
+}
+
+func (t *tx) Remove(key []byte) (bool, error) {
+	value, err := t.get(key)
+	if err != nil {
+		return false, err
+	}
+	t.writes[string(key)] = &txWrite{remove: true}
+	return value != nil, nil
+}
+
+func (t *tx) Get(key []byte) (io.ReadCloser, error) {
+	bs, err := t.GetBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(bs)), nil
+}
+
+func (t *tx) GetBytes(key []byte) ([]byte, error) {
+	value, err := t.get(key)
+	if err != nil {
+		return nil, err
+	} else if value == nil {
+		return nil, keyval.ErrNotFound
+	}
+	bs := make([]byte, len(value))
+	copy(bs, value)
+	return bs, nil
+}
+
+func (t *tx) Rollback() error {
+	if t.done {
+		return keyval.ErrTxDone
+	}
+	t.done = true
+	return nil
+}
+
+func (t *tx) Commit() error {
+	if t.done {
+		return keyval.ErrTxDone
+	}
+	t.done = true
+
+	f := t.f
+
+	temps := make(map[string]*tempFile)
+	abort := func() {
+		for _, tf := range temps {
+			abortTemp(tf.file)
+		}
+	}
+
+	for k, w := range t.writes {
+		if w.remove {
+			continue
+		}
+		tf, err := f.writeTemp(context.Background(), []byte(k), bytes.NewReader(w.value), time.Time{})
+		if err != nil {
+			abort()
+			return err
+		}
+		if err := syncTemp(tf.file); err != nil {
+			abort()
+			return err
+		}
+		temps[k] = tf
+	}
+
+	var keys [][]byte
+	for k := range t.reads {
+		keys = append(keys, []byte(k))
+	}
+	for k := range t.writes {
+		keys = append(keys, []byte(k))
+	}
+
+	f.txLock.Lock()
+	defer f.txLock.Unlock()
+
+	unlock := f.locks.LockAll(keys)
+	defer unlock()
+
+	for k, r := range t.reads {
+		current, err := f.current([]byte(k))
+		if err != nil {
+			abort()
+			return err
+		}
+		if (current != nil) != r.exists || (current != nil && !bytes.Equal(current.Hash(), r.hash)) {
+			abort()
+			return keyval.ErrConflict
+		}
+	}
+
+	j := &journal{}
+	for k, w := range t.writes {
+		current, err := f.current([]byte(k))
+		if err != nil {
+			abort()
+			return err
+		}
+
+		path, err := filepath.Rel(f.path, f.key([]byte(k)))
+		if err != nil {
+			abort()
+			return err
+		}
+		entry := journalEntry{Key: k, Path: path}
+
+		if w.remove {
+			if current == nil {
+				continue
+			}
+		} else {
+			if s, err := os.Stat(f.key([]byte(k))); err == nil && s.IsDir() {
+				abort()
+				return keyval.ErrInvalidKey
+			}
+			tf := temps[k]
+			if entry.Temp, err = filepath.Rel(f.path, tf.file.Name()); err != nil {
+				abort()
+				return err
+			}
+			if current != nil {
+				tf.info.ctime = current.Ctime()
+			}
+			entry.Info = tf.info
+		}
+
+		j.Entries = append(j.Entries, entry)
+	}
+
+	bs, err := msgpack.Marshal(j)
+	if err != nil {
+		abort()
+		return err
+	}
+
+	if err := writeFileAtomic(filepath.Join(f.path, journalName), bs); err != nil {
+		abort()
+		return err
+	}
+
+	return f.applyJournal(j)
+}
+
+type journalEntry struct {
+	Key string
+	// Path of the value, relative to the store
+	Path string
+	// Temp is the file to move to Path, or empty if the value is removed
+	Temp string
+	Info *Info
+}
+
+type journal struct {
+	Entries []journalEntry
+}
+
+// applyJournal moves the files of a committed transaction into place,
+// updates the index and removes the journal. It is safe to apply
+// a journal more than once.
+func (f *filesystem) applyJournal(j *journal) error {
+	dirs := make(map[string]bool)
+	changes := make(map[string]*Info)
+	events := make([]keyval.Event, 0, len(j.Entries))
+
+	for _, e := range j.Entries {
+		path := filepath.Join(f.path, e.Path)
+		event := keyval.Event{Type: keyval.EventDeleted, Key: []byte(e.Key)}
+		if e.Temp == "" {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := f.removeKey(path); err != nil {
+				return err
+			}
+			changes[e.Key] = nil
+		} else {
+			event.Type = keyval.EventCreated
+			if _, ok := f.index.Get(e.Key); ok {
+				event.Type = keyval.EventUpdated
+			} else if err := f.writeKey([]byte(e.Key), path); err != nil {
+				return err
+			}
+			// A missing temporary file was moved into place already
+			if err := os.Rename(filepath.Join(f.path, e.Temp), path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			changes[e.Key] = e.Info
+		}
+		events = append(events, event)
+		dirs[filepath.Dir(path)] = true
+	}
+
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+
+	if err := f.apply(changes, events); err != nil {
+		return err
+	}
+
+	for _, e := range j.Entries {
+		if e.Temp != "" {
+			if err := f.snapshot([]byte(e.Key), e.Info); err != nil {
+				return err
+			}
+		}
+	}
+
+	return os.Remove(filepath.Join(f.path, journalName))
+}
+
+// recover rolls forward a transaction interrupted after its journal
+// was written. Without a journal, the temporary files of an interrupted
+// commit are removed by cleanTemp.
+func (f *filesystem) recover() error {
+	path := filepath.Join(f.path, journalName)
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var j journal
+	if err := msgpack.Unmarshal(bs, &j); err != nil {
+		zap.L().Sugar().Warnf("Discarding corrupt transaction journal %s: %s", path, err)
+		return os.Remove(path)
+	}
+
+	zap.L().Sugar().Infof("Rolling forward interrupted transaction with %d changes", len(j.Entries))
+	return f.applyJournal(&j)
+}
@@ -0,0 +1,192 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+)
+
+// versionsDir keeps old versions, mirroring the paths of the values.
+// Versions of the value at path p are kept in versionsDir/p.v, along
+// with a manifest describing them.
+const versionsDir = "__versions"
+
+const manifestName = "manifest"
+
+// versionedFS is a filesystem store with versioning enabled.
+type versionedFS struct {
+	*filesystem
+}
+
+// versionDir returns the directory keeping the versions of the value at path.
+func (f *filesystem) versionDir(path string) (string, error) {
+	rel, err := filepath.Rel(f.path, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(f.path, versionsDir, rel+".v"), nil
+}
+
+// snapshot keeps the value just written to key as a new version.
+// Callers must hold the key lock.
+func (f *filesystem) snapshot(key []byte, info *Info) error {
+	if f.retention == nil {
+		return nil
+	}
+
+	path := f.key(key)
+	dir, err := f.versionDir(path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	id := keyval.NewVersionID(info.mtime)
+
+	// Values are replaced by renaming, so a version can share its file
+	// with the current value.
+	if err := os.Link(path, filepath.Join(dir, id)); err != nil {
+		if err := copyFile(path, filepath.Join(dir, id)); err != nil {
+			return err
+		}
+	}
+
+	versions, err := readManifest(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	versions = append([]keyval.Version{{
+		ID:      id,
+		Created: info.mtime,
+		Size:    info.size,
+		Hash:    info.hash,
+	}}, versions...)
+
+	keep, drop := f.retention.Apply(versions, time.Now())
+	for _, v := range drop {
+		if err := os.Remove(filepath.Join(dir, v.ID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	bs, err := json.Marshal(keep)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, manifestName), bs)
+}
+
+func readManifest(dir string) ([]keyval.Version, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	var versions []keyval.Version
+	if err := json.Unmarshal(bs, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	file, err := createTemp(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, in); err != nil {
+		abortTemp(file)
+		return err
+	}
+	return commitTemp(file, dst)
+}
+
+// moveVersions moves the versions of the value at src along with it.
+func (f *filesystem) moveVersions(src, dst string) error {
+	from, err := f.versionDir(src)
+	if err != nil {
+		return err
+	}
+	to, err := f.versionDir(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(from); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	removeEmptyParents(filepath.Join(f.path, versionsDir), from)
+	return nil
+}
+
+func (f *versionedFS) Versions(key []byte) ([]keyval.Version, error) {
+	if err := f.ValidateKey(key); err != nil {
+		return nil, err
+	}
+
+	f.locks.Lock(key)
+	defer f.locks.Unlock(key)
+
+	dir, err := f.versionDir(f.key(key))
+	if err != nil {
+		return nil, err
+	}
+	versions, err := readManifest(dir)
+	if os.IsNotExist(err) {
+		return nil, keyval.ErrNotFound
+	}
+	return versions, err
+}
+
+func (f *versionedFS) GetVersion(key []byte, id string) (io.ReadCloser, error) {
+	if err := f.ValidateKey(key); err != nil {
+		return nil, err
+	}
+	if id == "" || id == manifestName || strings.ContainsAny(id, `/\.`) {
+		return nil, keyval.ErrNotFound
+	}
+
+	dir, err := f.versionDir(f.key(key))
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filepath.Join(dir, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, keyval.ErrNotFound
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *versionedFS) Restore(key []byte, id string) error {
+	value, err := f.GetVersion(key, id)
+	if err != nil {
+		return err
+	}
+	defer value.Close()
+	return f.set(context.Background(), key, value, time.Time{}, nil)
+}
@@ -0,0 +1,257 @@
+package filesystem
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kildevaeld/keyval"
+	"go.uber.org/zap"
+)
+
+// Watch publishes changes made through the store, and changes made to
+// the store directory by other processes, which are picked up with
+// inotify. Paths of hashed keys can't be mapped back to their keys, so
+// with hash_keys only changes made through the store are seen.
+func (f *filesystem) Watch(ctx context.Context, prefix []byte) (<-chan keyval.Event, error) {
+	if f.hashKeys != "" {
+		return f.hub.Subscribe(ctx, prefix)
+	}
+
+	if err := f.startNotify(); err != nil {
+		return nil, err
+	}
+
+	ch, err := f.hub.Subscribe(ctx, prefix)
+	if err != nil {
+		f.stopNotify()
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		f.stopNotify()
+	}()
+
+	return ch, nil
+}
+
+func (f *filesystem) startNotify() error {
+	f.watchLock.Lock()
+	defer f.watchLock.Unlock()
+
+	if f.watchers == 0 {
+		n, err := newNotifier(f)
+		if err != nil {
+			return err
+		}
+		f.notify = n
+	}
+	f.watchers++
+	return nil
+}
+
+func (f *filesystem) stopNotify() {
+	f.watchLock.Lock()
+	defer f.watchLock.Unlock()
+
+	f.watchers--
+	if f.watchers == 0 {
+		f.notify.close()
+		f.notify = nil
+	}
+}
+
+// createDelay is how long a created file is given to be written, before
+// it is indexed. A file written in place is seen as created and then
+// written, which is published as a single created event.
+const createDelay = 50 * time.Millisecond
+
+// notifier applies changes made behind the back of the store to the index,
+// and publishes them.
+type notifier struct {
+	f       *filesystem
+	watcher *fsnotify.Watcher
+
+	// pending holds the files created within createDelay
+	lock    sync.Mutex
+	pending map[string]*time.Timer
+}
+
+func newNotifier(f *filesystem) (*notifier, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &notifier{
+		f:       f,
+		watcher: w,
+		pending: make(map[string]*time.Timer),
+	}
+	if err := n.addDirs(f.path, false); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	go n.run()
+
+	return n, nil
+}
+
+// addDirs watches root and all directories below it. Files in a newly
+// created directory may have been written before it was watched, so
+// they are handled as created.
+func (n *notifier) addDirs(root string, created bool) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if rel, _ := filepath.Rel(n.f.path, path); rel == versionsDir {
+				return filepath.SkipDir
+			}
+			return n.watcher.Add(path)
+		}
+		if created {
+			n.event(path, fsnotify.Create)
+		}
+		return nil
+	})
+}
+
+func (n *notifier) run() {
+	for {
+		select {
+		case event, ok := <-n.watcher.Events:
+			if !ok {
+				return
+			}
+			n.event(event.Name, event.Op)
+		case err, ok := <-n.watcher.Errors:
+			if !ok {
+				return
+			}
+			zap.L().Sugar().Warnf("Watching %s: %s", n.f.path, err)
+		}
+	}
+}
+
+// event handles a change to path. Created files are handled once they
+// have not changed for createDelay, so changes made while writing them
+// are part of their creation.
+func (n *notifier) event(path string, op fsnotify.Op) {
+	n.lock.Lock()
+	if t, ok := n.pending[path]; ok {
+		t.Reset(createDelay)
+		n.lock.Unlock()
+		return
+	}
+
+	if op&fsnotify.Create != 0 {
+		if s, err := os.Stat(path); err == nil && !s.IsDir() {
+			var t *time.Timer
+			t = time.AfterFunc(createDelay, func() {
+				n.lock.Lock()
+				// A reset timer may fire twice
+				if n.pending[path] != t {
+					n.lock.Unlock()
+					return
+				}
+				delete(n.pending, path)
+				n.lock.Unlock()
+
+				n.handle(path, fsnotify.Create)
+			})
+			n.pending[path] = t
+			n.lock.Unlock()
+			return
+		}
+	}
+	n.lock.Unlock()
+
+	n.handle(path, op)
+}
+
+func (n *notifier) handle(path string, op fsnotify.Op) {
+	f := n.f
+
+	rel, err := filepath.Rel(f.path, path)
+	if err != nil || isReserved(rel) || isTemp(path) {
+		return
+	}
+
+	if op&fsnotify.Create != 0 {
+		if s, err := os.Stat(path); err == nil && s.IsDir() {
+			if err := n.addDirs(path, true); err != nil {
+				zap.L().Sugar().Warnf("Watching %s: %s", path, err)
+			}
+			return
+		}
+	}
+
+	key := []byte(filepath.ToSlash(rel))
+	if err := f.ValidateKey(key); err != nil {
+		return
+	}
+
+	// Changes made through the store hold the key lock until the index
+	// is updated, so they are recognized by matching the index.
+	f.locks.Lock(key)
+	defer f.locks.Unlock(key)
+
+	indexed, ok := f.index.Get(string(key))
+
+	s, err := os.Stat(path)
+	if err != nil || s.IsDir() {
+		if ok {
+			if err := f.index.Delete(string(key)); err != nil {
+				zap.L().Sugar().Warnf("Updating index for %s: %s", key, err)
+			}
+			f.hub.Publish(keyval.EventDeleted, key)
+		}
+		return
+	}
+
+	if ok && indexed.size == s.Size() && indexed.mtime.Equal(s.ModTime()) {
+		return
+	}
+
+	info, err := f.infoFromFile(path)
+	if err != nil {
+		zap.L().Sugar().Warnf("Updating index for %s: %s", key, err)
+		return
+	}
+
+	event := keyval.EventCreated
+	if ok {
+		info.ctime = indexed.ctime
+		event = keyval.EventUpdated
+	} else if op&fsnotify.Create == 0 {
+		event = keyval.EventUpdated
+	}
+
+	if err := f.index.Put(string(key), info); err != nil {
+		zap.L().Sugar().Warnf("Updating index for %s: %s", key, err)
+		return
+	}
+
+	f.hub.Publish(event, key)
+}
+
+func (n *notifier) close() {
+	n.watcher.Close()
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for path, t := range n.pending {
+		t.Stop()
+		delete(n.pending, path)
+	}
+}
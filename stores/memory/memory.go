@@ -2,75 +2,492 @@ package memory
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"sync"
+	"time"
 
-	"github.com/gobwas/glob"
 	"github.com/kildevaeld/keyval"
 )
 
+var (
+	_ keyval.KeyValStoreContext     = (*memory)(nil)
+	_ keyval.KeyValMetaStoreContext = (*memory)(nil)
+	_ keyval.KeyValMetaStore        = (*memory)(nil)
+	_ keyval.TTLStore               = (*memory)(nil)
+	_ keyval.Expirer                = (*memory)(nil)
+	_ keyval.ConditionalStore       = (*memory)(nil)
+	_ keyval.Batcher                = (*memory)(nil)
+	_ keyval.Transactional          = (*memory)(nil)
+	_ keyval.RangeStore             = (*memory)(nil)
+	_ keyval.Watcher                = (*memory)(nil)
+	_ keyval.MetadataStore          = (*memory)(nil)
+	_ keyval.RangeReader            = (*memory)(nil)
+	_ keyval.Appender               = (*memory)(nil)
+)
+
+type entry struct {
+	value   []byte
+	hash    []byte
+	ctime   time.Time
+	mtime   time.Time
+	expires time.Time
+	meta    keyval.Metadata
+}
+
+func (e *entry) stat() keyval.Stat {
+	return keyval.NewStateMetadata(int64(len(e.value)), e.hash, e.ctime, e.mtime, e.expires, e.meta)
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return keyval.Expired(e.expires, now)
+}
+
+type MemoryOptions struct {
+	Hash string `json:"hash,omitempty"`
+}
+
 type memory struct {
-	mem map[string][]byte
+	mem  map[string]*entry
+	keys keyval.SortedKeys
+	lock sync.RWMutex
+	hash string
+	hub  keyval.Hub
 }
 
 func (m *memory) Set(key []byte, reader io.Reader) error {
-	bs, err := ioutil.ReadAll(reader)
+	return m.SetContext(context.Background(), key, reader)
+}
+
+func (m *memory) SetContext(ctx context.Context, key []byte, reader io.Reader) error {
+	bs, err := ioutil.ReadAll(keyval.NewContextReader(ctx, reader))
 	if err != nil {
 		return err
 	}
 
-	return m.SetBytes(key, bs)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return m.set(key, bs, time.Time{}, nil)
 }
 
 func (m *memory) SetBytes(key []byte, bytes []byte) error {
-	m.mem[string(key)] = bytes
+	return m.SetBytesContext(context.Background(), key, bytes)
+}
+
+func (m *memory) SetBytesContext(ctx context.Context, key []byte, bytes []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	value := make([]byte, len(bytes))
+	copy(value, bytes)
+
+	return m.set(key, value, time.Time{}, nil)
+}
+
+func (m *memory) SetWithTTL(key []byte, reader io.Reader, ttl time.Duration) error {
+	bs, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return m.set(key, bs, keyval.ExpiresAt(ttl), nil)
+}
+
+func (m *memory) SetBytesWithTTL(key []byte, bytes []byte, ttl time.Duration) error {
+	value := make([]byte, len(bytes))
+	copy(value, bytes)
+
+	return m.set(key, value, keyval.ExpiresAt(ttl), nil)
+}
+
+func (m *memory) SetWithOptions(ctx context.Context, key []byte, reader io.Reader, options keyval.SetOptions) error {
+	bs, err := ioutil.ReadAll(keyval.NewContextReader(ctx, reader))
+	if err != nil {
+		return err
+	}
+
+	var expires time.Time
+	if options.TTL > 0 {
+		expires = keyval.ExpiresAt(options.TTL)
+	}
+
+	e, err := m.newEntry(bs, expires)
+	if err != nil {
+		return err
+	}
+	e.meta = options.Metadata.Copy()
+
+	return m.setEntry(key, e, options.Condition)
+}
+
+func (m *memory) Append(key []byte, reader io.Reader) error {
+	return m.writeAt(key, -1, reader)
+}
+
+func (m *memory) WriteAt(key []byte, offset int64, reader io.Reader) error {
+	if offset < 0 {
+		return keyval.ErrInvalidRange
+	}
+	return m.writeAt(key, offset, reader)
+}
+
+// writeAt replaces the value of key with a spliced copy, keeping its
+// expiry and metadata. A negative offset appends.
+func (m *memory) writeAt(key []byte, offset int64, reader io.Reader) error {
+	bs, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var current []byte
+	old, ok := m.mem[string(key)]
+	if ok && old.expired(time.Now()) {
+		ok = false
+	}
+	if ok {
+		current = old.value
+	}
+	if offset < 0 {
+		offset = int64(len(current))
+	}
+
+	value, err := keyval.Splice(current, offset, bs)
+	if err != nil {
+		return err
+	}
+
+	e, err := m.newEntry(value, time.Time{})
+	if err != nil {
+		return err
+	}
+	if ok {
+		e.expires = old.expires
+		e.meta = old.meta
+	}
+
+	m.put(key, e)
+	return nil
+}
+
+func (m *memory) SetIfNotExists(key []byte, reader io.Reader) error {
+	bs, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return m.set(key, bs, time.Time{}, keyval.IfNotExists)
+}
+
+func (m *memory) SetIfMatch(key []byte, reader io.Reader, match []byte) error {
+	bs, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return m.set(key, bs, time.Time{}, keyval.IfMatch(match))
+}
+
+func (m *memory) DeleteIfMatch(key []byte, match []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := keyval.IfMatch(match)(m.current(key, time.Now())); err != nil {
+		return err
+	}
+
+	m.del(key, time.Now())
+	return nil
+}
+
+// current returns the stat of the live value of key, or nil.
+// Callers must hold the lock.
+func (m *memory) current(key []byte, now time.Time) keyval.Stat {
+	if e, ok := m.mem[string(key)]; ok && !e.expired(now) {
+		return e.stat()
+	}
+	return nil
+}
+
+func (m *memory) newEntry(value []byte, expires time.Time) (*entry, error) {
+	hash, err := keyval.NewHash(m.hash)
+	if err != nil {
+		return nil, err
+	}
+	hash.Write(value)
+	now := time.Now()
+
+	return &entry{
+		value:   value,
+		hash:    hash.Sum(nil),
+		ctime:   now,
+		mtime:   now,
+		expires: expires,
+	}, nil
+}
+
+func (m *memory) set(key []byte, value []byte, expires time.Time, cond keyval.Condition) error {
+	e, err := m.newEntry(value, expires)
+	if err != nil {
+		return err
+	}
+	return m.setEntry(key, e, cond)
+}
+
+func (m *memory) setEntry(key []byte, e *entry, cond keyval.Condition) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if cond != nil {
+		if err := cond(m.current(key, e.mtime)); err != nil {
+			return err
+		}
+	}
+
+	m.put(key, e)
 	return nil
 }
-func (m *memory) Has(bs []byte) bool {
-	_, ok := m.mem[string(bs)]
-	return ok
+
+// put stores e, keeping the creation time of a live value.
+// Callers must hold the lock.
+func (m *memory) put(key []byte, e *entry) {
+	typ := keyval.EventCreated
+	if old, ok := m.mem[string(key)]; ok && !old.expired(e.mtime) {
+		e.ctime = old.ctime
+		typ = keyval.EventUpdated
+	}
+	if typ == keyval.EventCreated {
+		m.keys.Insert(key)
+	}
+	m.mem[string(key)] = e
+	m.hub.Publish(typ, key)
 }
-func (m *memory) Remove(key []byte) bool {
-	_, ok := m.mem[string(key)]
+
+// del removes key, and reports whether it had a live value.
+// Callers must hold the lock.
+func (m *memory) del(key []byte, now time.Time) bool {
+	e, ok := m.mem[string(key)]
+	if !ok {
+		return false
+	}
 	delete(m.mem, string(key))
-	return ok
+	m.keys.Delete(key)
+	m.hub.Publish(keyval.EventDeleted, key)
+	return !e.expired(now)
 }
+
+type batch struct {
+	keyval.BatchOps
+	m *memory
+}
+
+// Commit applies all operations atomically
+func (b *batch) Commit() error {
+	entries := make([]*entry, len(b.Ops))
+	for i, op := range b.Ops {
+		if op.Type != keyval.BatchPut {
+			continue
+		}
+		value := make([]byte, len(op.Value))
+		copy(value, op.Value)
+		e, err := b.m.newEntry(value, time.Time{})
+		if err != nil {
+			return err
+		}
+		entries[i] = e
+	}
+
+	b.m.lock.Lock()
+	defer b.m.lock.Unlock()
+
+	for i, op := range b.Ops {
+		switch op.Type {
+		case keyval.BatchPut:
+			b.m.put(op.Key, entries[i])
+		case keyval.BatchDelete:
+			b.m.del(op.Key, time.Now())
+		}
+	}
+
+	b.Ops = nil
+	return nil
+}
+
+func (m *memory) Batch() keyval.Batch {
+	return &batch{m: m}
+}
+
+func (m *memory) Has(key []byte) (bool, error) {
+	return m.HasContext(context.Background(), key)
+}
+
+func (m *memory) HasContext(ctx context.Context, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	e, ok := m.mem[string(key)]
+	return ok && !e.expired(time.Now()), nil
+}
+
+func (m *memory) Remove(key []byte) (bool, error) {
+	return m.RemoveContext(context.Background(), key)
+}
+
+func (m *memory) RemoveContext(ctx context.Context, key []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.del(key, time.Now()), nil
+}
+
 func (m *memory) Get(key []byte) (io.ReadCloser, error) {
-	bs, err := m.GetBytes(key)
+	return m.GetContext(context.Background(), key)
+}
+
+func (m *memory) GetContext(ctx context.Context, key []byte) (io.ReadCloser, error) {
+	e, err := m.entry(ctx, key)
 	if err != nil {
 		return nil, err
 	}
-	return ioutil.NopCloser(bytes.NewReader(bs)), nil
+	return NewReader(e.value), nil
+}
+
+// GetRange slices the value, which is never modified once stored,
+// as writes replace the entry.
+func (m *memory) GetRange(key []byte, offset, length int64) (io.ReadCloser, error) {
+	e, err := m.entry(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(e.value))
+	if offset < 0 || offset > size {
+		return nil, keyval.ErrInvalidRange
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	return NewReader(e.value[offset : offset+length]), nil
 }
 
 func (m *memory) GetBytes(key []byte) ([]byte, error) {
-	bs, ok := m.mem[string(key)]
-	if !ok {
-		return nil, keyval.ErrNotFound
+	return m.GetBytesContext(context.Background(), key)
+}
+
+func (m *memory) GetBytesContext(ctx context.Context, key []byte) ([]byte, error) {
+	e, err := m.entry(ctx, key)
+	if err != nil {
+		return nil, err
 	}
+	bs := make([]byte, len(e.value))
+	copy(bs, e.value)
 	return bs, nil
 }
 
-func (m *memory) List(prefix []byte, fn func(key []byte, r io.ReadCloser) error) error {
-	g := glob.MustCompile(string(prefix))
-	for k, v := range m.mem {
-		if g.Match(string(k)) {
-			if err := fn([]byte(k), NewReader(v)); err != nil {
-				if err == keyval.ErrStopIter {
-					err = nil
-				}
-				return err
-			}
-		}
+// entry returns the current entry for key. Entries are never mutated
+// after being stored, so they can safely be used after the lock is released.
+func (m *memory) entry(ctx context.Context, key []byte) (*entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	e, ok := m.mem[string(key)]
+	if !ok || e.expired(time.Now()) {
+		return nil, keyval.ErrNotFound
+	}
+	return e, nil
+}
 
+func (m *memory) Stat(key []byte) (keyval.Stat, error) {
+	return m.StatContext(context.Background(), key)
+}
+
+func (m *memory) StatContext(ctx context.Context, key []byte) (keyval.Stat, error) {
+	e, err := m.entry(ctx, key)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return e.stat(), nil
+}
+
+func (m *memory) List(prefix []byte, fn func(key []byte, meta keyval.Stat) error) error {
+	return m.ListContext(context.Background(), prefix, fn)
+}
+
+func (m *memory) ListContext(ctx context.Context, prefix []byte, fn func(key []byte, meta keyval.Stat) error) error {
+	_, err := m.Range(ctx, keyval.RangeOptions{Prefix: prefix}, fn)
+	return err
+}
+
+func (m *memory) Range(ctx context.Context, options keyval.RangeOptions, fn func(key []byte, meta keyval.Stat) error) (string, error) {
+	// Select the page up front, so fn is free to modify the store
+	now := time.Now()
+	m.lock.RLock()
+	keys, more, err := m.keys.Page(options, func(key []byte) bool {
+		return !m.mem[string(key)].expired(now)
+	})
+	entries := make(map[string]*entry, len(keys))
+	for _, k := range keys {
+		entries[string(k)] = m.mem[string(k)]
+	}
+	m.lock.RUnlock()
+
+	if err != nil {
+		return "", err
+	}
+
+	return keyval.RangePage(ctx, keys, more, func(key []byte) (keyval.Stat, error) {
+		return entries[string(key)].stat(), nil
+	}, fn)
+}
+
+func (m *memory) Watch(ctx context.Context, prefix []byte) (<-chan keyval.Event, error) {
+	return m.hub.Subscribe(ctx, prefix)
+}
+
+func (m *memory) RemoveExpired() (int, error) {
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	count := 0
+	for k, e := range m.mem {
+		if e.expired(now) {
+			m.del([]byte(k), now)
+			count++
+		}
+	}
+	return count, nil
 }
 
 func init() {
 	keyval.Register("memory", func(options interface{}) (keyval.KeyValStore, error) {
+		var (
+			o  MemoryOptions
+			ok bool
+		)
+
+		if o, ok = options.(MemoryOptions); !ok && options != nil {
+			if err := keyval.GetOptions(options, &o); err != nil {
+				return nil, err
+			}
+		}
+
+		if !keyval.ValidHash(o.Hash) {
+			return nil, fmt.Errorf("invalid hash algorithm: %s", o.Hash)
+		}
+
 		return &memory{
-			mem: make(map[string][]byte),
+			mem:  make(map[string]*entry),
+			hash: o.Hash,
 		}, nil
 	})
 }
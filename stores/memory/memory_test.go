@@ -0,0 +1,415 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+)
+
+func newStore(t *testing.T) *memory {
+	s, err := keyval.Store("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*memory)
+}
+
+func TestConcurrentAccess(t *testing.T) {
+
+	m := newStore(t)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(4)
+
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := []byte(fmt.Sprintf("key/%d/%d", i, j%10))
+				if err := m.SetBytes(key, []byte("value")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := []byte(fmt.Sprintf("key/%d/%d", i, j%10))
+				if _, err := m.GetBytes(key); err != nil && err != keyval.ErrNotFound {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				err := m.List([]byte(fmt.Sprintf("key/%d/", i)), func(key []byte, stat keyval.Stat) error {
+					_, err := m.Stat(key)
+					if err == keyval.ErrNotFound {
+						err = nil
+					}
+					return err
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := []byte(fmt.Sprintf("key/%d/%d", i, j%10))
+				if _, err := m.Remove(key); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestSetCopiesValue(t *testing.T) {
+
+	m := newStore(t)
+
+	value := []byte("hello")
+	if err := m.SetBytes([]byte("key"), value); err != nil {
+		t.Fatal(err)
+	}
+	value[0] = 'j'
+
+	bs, err := m.GetBytes([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(bs) != "hello" {
+		t.Fatalf("expected stored value to be unaffected, got %q", bs)
+	}
+}
+
+func TestTTL(t *testing.T) {
+
+	m := newStore(t)
+
+	if err := m.SetBytesWithTTL([]byte("short"), []byte("value"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetBytesWithTTL([]byte("long"), []byte("value"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := m.Stat([]byte("long"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Expires().IsZero() {
+		t.Fatal("expected expiry time")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if has, _ := m.Has([]byte("short")); has {
+		t.Fatal("expected expired key to be gone")
+	}
+	if _, err := m.GetBytes([]byte("short")); err != keyval.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	n, err := m.RemoveExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 expired key, got %d", n)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	m := newStore(t)
+	m.SetBytes([]byte("index"), []byte("1"))
+
+	tx, err := m.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bs, err := tx.GetBytes([]byte("index")); err != nil || string(bs) != "1" {
+		t.Fatalf("expected 1, got %q (%v)", bs, err)
+	}
+	tx.SetBytes([]byte("index"), []byte("2"))
+	tx.SetBytes([]byte("data"), []byte("data"))
+
+	if removed, _ := tx.Remove([]byte("data")); !removed {
+		t.Fatal("expected to remove own write")
+	}
+	if has, _ := tx.Has([]byte("data")); has {
+		t.Fatal("expected data to be removed in transaction")
+	}
+	tx.SetBytes([]byte("data"), []byte("data"))
+
+	// Changes to other keys don't conflict
+	m.SetBytes([]byte("other"), []byte("other"))
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := m.GetBytes([]byte("index")); string(bs) != "2" {
+		t.Fatalf("expected 2, got %q", bs)
+	}
+
+	tx, _ = m.Begin()
+	tx.Has([]byte("missing"))
+	tx.SetBytes([]byte("index"), []byte("3"))
+	m.SetBytes([]byte("missing"), []byte("now present"))
+	if err := tx.Commit(); err != keyval.ErrConflict {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if bs, _ := m.GetBytes([]byte("index")); string(bs) != "2" {
+		t.Fatalf("expected failed commit to leave index, got %q", bs)
+	}
+}
+
+func TestRange(t *testing.T) {
+	m := newStore(t)
+	for _, k := range []string{"d", "b", "a/1", "c", "a-2", "e"} {
+		m.SetBytes([]byte(k), []byte(k))
+	}
+
+	collect := func(options keyval.RangeOptions) ([]string, string) {
+		var keys []string
+		cursor, err := m.Range(context.Background(), options, func(key []byte, stat keyval.Stat) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys, cursor
+	}
+
+	if keys, _ := collect(keyval.RangeOptions{}); fmt.Sprint(keys) != "[a-2 a/1 b c d e]" {
+		t.Fatalf("unexpected order: %v", keys)
+	}
+
+	if keys, _ := collect(keyval.RangeOptions{Start: []byte("b"), End: []byte("e")}); fmt.Sprint(keys) != "[b c d]" {
+		t.Fatalf("unexpected range: %v", keys)
+	}
+
+	if keys, _ := collect(keyval.RangeOptions{Start: []byte("b"), End: []byte("e"), Reverse: true}); fmt.Sprint(keys) != "[d c b]" {
+		t.Fatalf("unexpected reverse range: %v", keys)
+	}
+
+	for _, reverse := range []bool{false, true} {
+		var all []string
+		options := keyval.RangeOptions{Limit: 4, Reverse: reverse}
+		for {
+			keys, cursor := collect(options)
+			all = append(all, keys...)
+			if cursor == "" {
+				break
+			}
+			options.Cursor = cursor
+		}
+		expected := "[a-2 a/1 b c d e]"
+		if reverse {
+			expected = "[e d c b a/1 a-2]"
+		}
+		if fmt.Sprint(all) != expected {
+			t.Fatalf("unexpected pages: %v", all)
+		}
+	}
+
+	// An exhausted limit only returns a cursor if keys remain
+	if _, cursor := collect(keyval.RangeOptions{Limit: 6}); cursor != "" {
+		t.Fatalf("expected no cursor, got %s", cursor)
+	}
+
+	if _, err := m.Range(context.Background(), keyval.RangeOptions{Cursor: "!"}, nil); err != keyval.ErrInvalidCursor {
+		t.Fatalf("expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	m := newStore(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := m.Watch(ctx, []byte("a/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.SetBytes([]byte("a/1"), []byte("1"))
+	m.SetBytes([]byte("b"), []byte("b"))
+	m.SetBytes([]byte("a/1"), []byte("2"))
+	m.Remove([]byte("a/1"))
+
+	for _, expected := range []keyval.EventType{keyval.EventCreated, keyval.EventUpdated, keyval.EventDeleted} {
+		select {
+		case e := <-events:
+			if e.Type != expected || string(e.Key) != "a/1" {
+				t.Fatalf("expected %s a/1, got %s %s", expected, e.Type, e.Key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", expected)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	store := keyval.Versioned(newStore(t), keyval.Retention{Keep: 2})
+	vs := store.(keyval.VersionedStore)
+
+	for _, value := range []string{"1", "2", "3"} {
+		if err := store.SetBytes([]byte("key"), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := vs.Versions([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Size != 1 {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+
+	if err := vs.Restore([]byte("key"), versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := store.GetBytes([]byte("key")); string(bs) != "2" {
+		t.Fatalf("expected restored value 2, got %s", bs)
+	}
+
+	var keys []string
+	store.(keyval.KeyValMetaStore).List(nil, func(key []byte, stat keyval.Stat) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if fmt.Sprint(keys) != "[key]" {
+		t.Fatalf("expected versions to be hidden, got %v", keys)
+	}
+
+	if _, err := store.Get([]byte(keyval.VersionPrefix + "key.v/manifest")); err != keyval.ErrInvalidKey {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+
+	for _, id := range []string{"", "manifest"} {
+		if _, err := vs.GetVersion([]byte("key"), id); err != keyval.ErrNotFound {
+			t.Fatalf("expected ErrNotFound for version %q, got %v", id, err)
+		}
+	}
+
+	if _, ok := store.(keyval.KeyValStoreContext); !ok {
+		t.Fatal("expected context aware store")
+	}
+
+	// Concurrent writes are ordered by id, and the newest is current
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.SetBytes([]byte("concurrent"), []byte(strconv.Itoa(i)))
+		}(i)
+	}
+	wg.Wait()
+
+	versions, err = vs.Versions([]byte("concurrent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(versions); i++ {
+		if versions[i-1].ID <= versions[i].ID || versions[i-1].Created.Before(versions[i].Created) {
+			t.Fatalf("versions out of order: %+v", versions)
+		}
+	}
+	newest, err := vs.GetVersion([]byte("concurrent"), versions[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := ioutil.ReadAll(newest)
+	newest.Close()
+	if bs, _ := store.GetBytes([]byte("concurrent")); string(bs) != string(expected) {
+		t.Fatalf("expected current value %s, got %s", expected, bs)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	m := newStore(t)
+	m.SetBytes([]byte("key"), []byte("0123456789"))
+
+	tests := []struct {
+		offset, length int64
+		expected       string
+	}{
+		{0, 3, "012"},
+		{7, -1, "789"},
+		{8, 10, "89"},
+		{10, -1, ""},
+	}
+
+	for _, test := range tests {
+		reader, err := m.GetRange([]byte("key"), test.offset, test.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, _ := ioutil.ReadAll(reader)
+		if string(bs) != test.expected {
+			t.Fatalf("range %d+%d: expected %q, got %q", test.offset, test.length, test.expected, bs)
+		}
+	}
+
+	if _, err := m.GetRange([]byte("key"), 11, -1); err != keyval.ErrInvalidRange {
+		t.Fatalf("expected ErrInvalidRange, got %v", err)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	m := newStore(t)
+
+	if err := m.Append([]byte("log"), strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	m.Append([]byte("log"), strings.NewReader("bc"))
+
+	if err := m.WriteAt([]byte("log"), 1, strings.NewReader("XYZ")); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, _ := m.GetBytes([]byte("log"))
+	if string(bs) != "aXYZ" {
+		t.Fatalf("expected aXYZ, got %q", bs)
+	}
+
+	stat, _ := m.Stat([]byte("log"))
+	hash, _ := keyval.NewHash("")
+	hash.Write([]byte("aXYZ"))
+	if stat.Size() != 4 || string(stat.Hash()) != string(hash.Sum(nil)) {
+		t.Fatalf("stat not updated: %d %x", stat.Size(), stat.Hash())
+	}
+
+	if err := m.WriteAt([]byte("log"), 5, strings.NewReader("a")); err != keyval.ErrInvalidRange {
+		t.Fatalf("expected ErrInvalidRange, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package memory
+
+import (
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+)
+
+// tx stages writes as new entries, leaving the store untouched until
+// Commit swaps them in. Entries read are remembered, so reads are
+// repeatable and Commit can detect concurrent changes.
+type tx struct {
+	m      *memory
+	reads  map[string]*entry
+	writes map[string]*entry
+	done   bool
+}
+
+func (m *memory) Begin() (keyval.Tx, error) {
+	return &tx{
+		m:      m,
+		reads:  make(map[string]*entry),
+		writes: make(map[string]*entry),
+	}, nil
+}
+
+// get returns the entry of key as seen by the transaction, or nil.
+func (t *tx) get(key []byte) (*entry, error) {
+	if t.done {
+		return nil, keyval.ErrTxDone
+	}
+	if e, ok := t.writes[string(key)]; ok {
+		return e, nil
+	}
+	if e, ok := t.reads[string(key)]; ok {
+		return e, nil
+	}
+
+	t.m.lock.RLock()
+	e := t.m.mem[string(key)]
+	t.m.lock.RUnlock()
+
+	if e != nil && e.expired(time.Now()) {
+		e = nil
+	}
+	t.reads[string(key)] = e
+	return e, nil
+}
+
+func (t *tx) set(key []byte, value []byte) error {
+	if t.done {
+		return keyval.ErrTxDone
+	}
+	e, err := t.m.newEntry(value, time.Time{})
+	if err != nil {
+		return err
+	}
+	t.writes[string(key)] = e
+	return nil
+}
+
+func (t *tx) Set(key []byte, reader io.Reader) error {
+	bs, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return t.set(key, bs)
+}
+
+func (t *tx) SetBytes(key []byte, bytes []byte) error {
+	value := make([]byte, len(bytes))
+	copy(value, bytes)
+	return t.set(key, value)
+}
+
+func (t *tx) Has(key []byte) (bool, error) {
+	e, err := t.get(key)
+	return e != nil, err
+}
+
+func (t *tx) Remove(key []byte) (bool, error) {
+	e, err := t.get(key)
+	if err != nil {
+		return false, err
+	}
+	t.writes[string(key)] = nil
+	return e != nil, nil
+}
+
+func (t *tx) Get(key []byte) (io.ReadCloser, error) {
+	e, err := t.get(key)
+	if err != nil {
+		return nil, err
+	} else if e == nil {
+		return nil, keyval.ErrNotFound
+	}
+	return NewReader(e.value), nil
+}
+
+func (t *tx) GetBytes(key []byte) ([]byte, error) {
+	e, err := t.get(key)
+	if err != nil {
+		return nil, err
+	} else if e == nil {
+		return nil, keyval.ErrNotFound
+	}
+	bs := make([]byte, len(e.value))
+	copy(bs, e.value)
+	return bs, nil
+}
+
+func (t *tx) Commit() error {
+	if t.done {
+		return keyval.ErrTxDone
+	}
+	t.done = true
+
+	t.m.lock.Lock()
+	defer t.m.lock.Unlock()
+
+	now := time.Now()
+	for k, read := range t.reads {
+		e := t.m.mem[k]
+		if e != nil && e.expired(now) {
+			e = nil
+		}
+		if e != read {
+			return keyval.ErrConflict
+		}
+	}
+
+	for k, e := range t.writes {
+		if e == nil {
+			t.m.del([]byte(k), now)
+		} else {
+			e.mtime = now
+			e.ctime = now
+			t.m.put([]byte(k), e)
+		}
+	}
+
+	return nil
+}
+
+func (t *tx) Rollback() error {
+	if t.done {
+		return keyval.ErrTxDone
+	}
+	t.done = true
+	return nil
+}
@@ -0,0 +1,443 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+	redis "github.com/redis/go-redis/v9"
+)
+
+var (
+	_ keyval.KeyValStore            = (*store)(nil)
+	_ keyval.KeyValStoreContext     = (*store)(nil)
+	_ keyval.KeyValMetaStore        = (*store)(nil)
+	_ keyval.KeyValMetaStoreContext = (*store)(nil)
+	_ keyval.TTLStore               = (*store)(nil)
+)
+
+const (
+	DefaultAddr      = "localhost:6379"
+	DefaultPrefix    = "keyval:"
+	DefaultChunkSize = 512 << 10
+)
+
+// Replaced values are kept for a while, so readers streaming them can
+// finish. Values being written expire unless they are committed.
+const (
+	replacedTTL = time.Minute
+	pendingTTL  = time.Hour
+)
+
+var errReplaced = errors.New("value was replaced while reading")
+
+type RedisOptions struct {
+	Addr     string `json:"addr,omitempty"`
+	Password string `json:"password,omitempty"`
+	DB       int    `json:"db,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	// TLS connects using TLS, verifying the server unless TLSSkipVerify is set
+	TLS           bool   `json:"tls,omitempty"`
+	TLSSkipVerify bool   `json:"tls_skip_verify,omitempty" mapstructure:"tls_skip_verify"`
+	ChunkSize     int    `json:"chunk_size,omitempty" mapstructure:"chunk_size"`
+	Hash          string `json:"hash,omitempty"`
+}
+
+// commitScript points the stat hash at a new generation, expiring the
+// one it replaces.
+var commitScript = redis.NewScript(`
+local old = redis.call('HGET', KEYS[1], 'generation')
+local ctime = redis.call('HGET', KEYS[1], 'ctime') or ARGV[5]
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], 'generation', ARGV[2], 'chunks', ARGV[3], 'size', ARGV[4],
+	'ctime', ctime, 'mtime', ARGV[5], 'hash', ARGV[6], 'expires', ARGV[7])
+if tonumber(ARGV[8]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[8])
+	redis.call('PEXPIRE', KEYS[2], ARGV[8])
+else
+	redis.call('PERSIST', KEYS[2])
+end
+if old and old ~= ARGV[2] then
+	redis.call('PEXPIRE', ARGV[1] .. old, ARGV[9])
+end
+return 1
+`)
+
+var removeScript = redis.NewScript(`
+local old = redis.call('HGET', KEYS[1], 'generation')
+if not old then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+redis.call('PEXPIRE', ARGV[1] .. old, ARGV[2])
+return 1
+`)
+
+// Each value is a list of chunks at prefix+"d:"+generation, described
+// by a stat hash at prefix+"s:"+key. Generations are allocated from
+// prefix+"generation", so a value is never written in place.
+type store struct {
+	client    *redis.Client
+	prefix    string
+	chunkSize int
+	hash      string
+}
+
+func (s *store) statKey(key []byte) string {
+	return s.prefix + "s:" + string(key)
+}
+
+func (s *store) dataKey(generation string) string {
+	return s.prefix + "d:" + generation
+}
+
+func (s *store) Set(key []byte, reader io.Reader) error {
+	return s.set(context.Background(), key, reader, 0)
+}
+
+func (s *store) SetContext(ctx context.Context, key []byte, reader io.Reader) error {
+	return s.set(ctx, key, reader, 0)
+}
+
+func (s *store) SetBytes(key []byte, bs []byte) error {
+	return s.set(context.Background(), key, bytes.NewReader(bs), 0)
+}
+
+func (s *store) SetBytesContext(ctx context.Context, key []byte, bs []byte) error {
+	return s.set(ctx, key, bytes.NewReader(bs), 0)
+}
+
+func (s *store) SetWithTTL(key []byte, reader io.Reader, ttl time.Duration) error {
+	return s.set(context.Background(), key, reader, ttl)
+}
+
+func (s *store) SetBytesWithTTL(key []byte, bs []byte, ttl time.Duration) error {
+	return s.set(context.Background(), key, bytes.NewReader(bs), ttl)
+}
+
+// set streams reader into a new generation a chunk at a time, and
+// commits it once complete.
+func (s *store) set(ctx context.Context, key []byte, reader io.Reader, ttl time.Duration) error {
+	if len(key) == 0 {
+		return keyval.ErrInvalidKey
+	}
+
+	hash, err := keyval.NewHash(s.hash)
+	if err != nil {
+		return err
+	}
+
+	id, err := s.client.Incr(ctx, s.prefix+"generation").Result()
+	if err != nil {
+		return err
+	}
+	generation := strconv.FormatInt(id, 10)
+	data := s.dataKey(generation)
+
+	var size, chunks int64
+	buf := make([]byte, s.chunkSize)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			_, e := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.RPush(ctx, data, buf[:n])
+				pipe.PExpire(ctx, data, pendingTTL)
+				return nil
+			})
+			if e != nil {
+				s.client.Del(context.Background(), data)
+				return e
+			}
+			size += int64(n)
+			chunks++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			s.client.Del(context.Background(), data)
+			return err
+		}
+	}
+
+	now := time.Now()
+	var expires int64
+	if ttl > 0 {
+		expires = now.Add(ttl).UnixNano()
+	}
+
+	err = commitScript.Run(ctx, s.client, []string{s.statKey(key), data},
+		s.dataKey(""), generation, chunks, size, now.UnixNano(), hash.Sum(nil), expires,
+		ttl.Milliseconds(), replacedTTL.Milliseconds()).Err()
+	if err != nil {
+		s.client.Del(context.Background(), data)
+		return err
+	}
+	return nil
+}
+
+func (s *store) Has(key []byte) (bool, error) {
+	return s.HasContext(context.Background(), key)
+}
+
+func (s *store) HasContext(ctx context.Context, key []byte) (bool, error) {
+	n, err := s.client.Exists(ctx, s.statKey(key)).Result()
+	return n > 0, err
+}
+
+func (s *store) Remove(key []byte) (bool, error) {
+	return s.RemoveContext(context.Background(), key)
+}
+
+func (s *store) RemoveContext(ctx context.Context, key []byte) (bool, error) {
+	n, err := removeScript.Run(ctx, s.client, []string{s.statKey(key)},
+		s.dataKey(""), replacedTTL.Milliseconds()).Int()
+	return n > 0, err
+}
+
+func (s *store) Get(key []byte) (io.ReadCloser, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext streams the chunks of the current generation. A reader
+// fails with errReplaced, if it is still reading when the replaced
+// generation expires.
+func (s *store) GetContext(ctx context.Context, key []byte) (io.ReadCloser, error) {
+	values, err := s.client.HMGet(ctx, s.statKey(key), "generation", "chunks").Result()
+	if err != nil {
+		return nil, err
+	}
+	generation, _ := values[0].(string)
+	if generation == "" {
+		return nil, keyval.ErrNotFound
+	}
+	chunks, err := strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&chunkReader{
+		ctx:    ctx,
+		client: s.client,
+		key:    s.dataKey(generation),
+		chunks: chunks,
+	}), nil
+}
+
+func (s *store) GetBytes(key []byte) ([]byte, error) {
+	return s.GetBytesContext(context.Background(), key)
+}
+
+func (s *store) GetBytesContext(ctx context.Context, key []byte) ([]byte, error) {
+	reader, err := s.GetContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func (s *store) Stat(key []byte) (keyval.Stat, error) {
+	return s.StatContext(context.Background(), key)
+}
+
+func (s *store) StatContext(ctx context.Context, key []byte) (keyval.Stat, error) {
+	fields, err := s.client.HGetAll(ctx, s.statKey(key)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return toStat(fields)
+}
+
+func (s *store) List(prefix []byte, fn func(key []byte, meta keyval.Stat) error) error {
+	return s.ListContext(context.Background(), prefix, fn)
+}
+
+// ListContext scans stat hashes matching the literal part of prefix.
+// SCAN returns keys in no particular order, so they are sorted before
+// their stats are read.
+func (s *store) ListContext(ctx context.Context, prefix []byte, fn func(key []byte, meta keyval.Stat) error) error {
+	match, err := keyval.Matcher(prefix)
+	if err != nil {
+		return err
+	}
+
+	prefix = keyval.LiteralPrefix(prefix)
+
+	statPrefix := s.statKey(nil)
+	pattern := escapePattern(statPrefix+string(prefix)) + "*"
+
+	var keys [][]byte
+	iter := s.client.Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		key := []byte(strings.TrimPrefix(iter.Val(), statPrefix))
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	keyval.SortKeys(keys)
+
+	cmds, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.HGetAll(ctx, s.statKey(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, cmd := range cmds {
+		stat, err := toStat(cmd.(*redis.MapStringStringCmd).Val())
+		if errors.Is(err, keyval.ErrNotFound) {
+			// Removed since the scan
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn(keys[i], stat); err != nil {
+			if errors.Is(err, keyval.ErrStopIter) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *store) Close() error {
+	return s.client.Close()
+}
+
+func toStat(fields map[string]string) (keyval.Stat, error) {
+	if len(fields) == 0 {
+		return nil, keyval.ErrNotFound
+	}
+
+	var n [4]int64
+	for i, name := range []string{"size", "ctime", "mtime", "expires"} {
+		v, err := strconv.ParseInt(fields[name], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stat field %s: %s", name, err)
+		}
+		n[i] = v
+	}
+
+	var expires time.Time
+	if n[3] > 0 {
+		expires = time.Unix(0, n[3])
+	}
+
+	return keyval.NewStateExpires(n[0], []byte(fields["hash"]), time.Unix(0, n[1]), time.Unix(0, n[2]), expires), nil
+}
+
+// escapePattern escapes the glob characters of a SCAN pattern
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type chunkReader struct {
+	ctx    context.Context
+	client *redis.Client
+	key    string
+	chunks int64
+	index  int64
+	buf    []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.index == c.chunks {
+			return 0, io.EOF
+		}
+		bs, err := c.client.LIndex(c.ctx, c.key, c.index).Bytes()
+		if err == redis.Nil {
+			return 0, errReplaced
+		} else if err != nil {
+			return 0, err
+		}
+		c.buf = bs
+		c.index++
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func init() {
+	keyval.Register("redis", func(options interface{}) (keyval.KeyValStore, error) {
+		var (
+			o  RedisOptions
+			ok bool
+		)
+
+		if o, ok = options.(RedisOptions); !ok && options != nil {
+			if err := keyval.GetOptions(options, &o); err != nil {
+				return nil, err
+			}
+		}
+
+		if o.Addr == "" {
+			o.Addr = DefaultAddr
+		}
+		if o.Prefix == "" {
+			o.Prefix = DefaultPrefix
+		}
+		if o.ChunkSize <= 0 {
+			o.ChunkSize = DefaultChunkSize
+		}
+		if !keyval.ValidHash(o.Hash) {
+			return nil, fmt.Errorf("invalid hash algorithm: %s", o.Hash)
+		}
+
+		ro := &redis.Options{
+			Addr:     o.Addr,
+			Password: o.Password,
+			DB:       o.DB,
+		}
+		if o.TLS {
+			host, _, err := net.SplitHostPort(o.Addr)
+			if err != nil {
+				return nil, err
+			}
+			ro.TLSConfig = &tls.Config{
+				ServerName:         host,
+				InsecureSkipVerify: o.TLSSkipVerify,
+			}
+		}
+
+		client := redis.NewClient(ro)
+		if err := client.Ping(context.Background()).Err(); err != nil {
+			client.Close()
+			return nil, err
+		}
+
+		return &store{
+			client:    client,
+			prefix:    o.Prefix,
+			chunkSize: o.ChunkSize,
+			hash:      o.Hash,
+		}, nil
+	})
+}
@@ -0,0 +1,151 @@
+package redis
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/kildevaeld/keyval"
+)
+
+func newStore(t *testing.T, options map[string]interface{}) (*store, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options["addr"] = mr.Addr()
+
+	s, err := keyval.Store("redis", options)
+	if err != nil {
+		mr.Close()
+		t.Fatal(err)
+	}
+	return s.(*store), mr
+}
+
+func TestSet(t *testing.T) {
+	s, mr := newStore(t, map[string]interface{}{"chunk_size": 4, "prefix": "test:"})
+	defer mr.Close()
+	defer s.Close()
+
+	value := []byte("a value spanning several chunks")
+	if err := s.Set([]byte("key"), bytes.NewReader(value)); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := s.GetBytes([]byte("key")); err != nil || !bytes.Equal(bs, value) {
+		t.Fatalf("expected value, got %q %v", bs, err)
+	}
+
+	stat, err := s.Stat([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != int64(len(value)) || len(stat.Hash()) == 0 {
+		t.Fatalf("unexpected stat: %d %x", stat.Size(), stat.Hash())
+	}
+	if n, _ := mr.List("test:d:1"); len(n) != 8 {
+		t.Fatalf("expected 8 chunks, got %d", len(n))
+	}
+
+	// Readers in flight finish reading a replaced value
+	reader, err := s.Get([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetBytes([]byte("key"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(reader); err != nil || !bytes.Equal(buf.Bytes(), value) {
+		t.Fatalf("expected old value, got %q %v", buf.Bytes(), err)
+	}
+
+	second, _ := s.Stat([]byte("key"))
+	if !second.Ctime().Equal(stat.Ctime()) {
+		t.Fatal("expected ctime to be kept")
+	}
+
+	// The replaced generation expires
+	mr.FastForward(2 * replacedTTL)
+	if mr.Exists("test:d:1") {
+		t.Fatal("expected replaced chunks to expire")
+	}
+
+	if removed, err := s.Remove([]byte("key")); err != nil || !removed {
+		t.Fatalf("expected key to be removed: %v", err)
+	}
+	if removed, _ := s.Remove([]byte("key")); removed {
+		t.Fatal("expected key to be removed once")
+	}
+	if _, err := s.Get([]byte("key")); err != keyval.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.Stat([]byte("key")); err != keyval.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	s, mr := newStore(t, map[string]interface{}{})
+	defer mr.Close()
+	defer s.Close()
+
+	if err := s.SetBytesWithTTL([]byte("key"), []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := s.Stat([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Expires().IsZero() {
+		t.Fatal("expected expiry")
+	}
+
+	// Setting the value again without ttl persists it
+	mr.FastForward(2 * time.Minute)
+	if has, _ := s.Has([]byte("key")); has {
+		t.Fatal("expected key to expire")
+	}
+
+	s.SetBytesWithTTL([]byte("key"), []byte("value"), time.Minute)
+	s.SetBytes([]byte("key"), []byte("value"))
+	mr.FastForward(2 * time.Minute)
+	if has, _ := s.Has([]byte("key")); !has {
+		t.Fatal("expected key to be persisted")
+	}
+}
+
+func TestList(t *testing.T) {
+	s, mr := newStore(t, map[string]interface{}{})
+	defer mr.Close()
+	defer s.Close()
+
+	for _, k := range []string{"b/1", "a/2", "a/1", "c", "a*"} {
+		s.SetBytes([]byte(k), []byte(k))
+	}
+
+	collect := func(prefix string) string {
+		var keys []string
+		err := s.List([]byte(prefix), func(key []byte, meta keyval.Stat) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, ",")
+	}
+
+	if keys := collect("a/"); keys != "a/1,a/2" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if keys := collect("*/1"); keys != "a/1,b/1" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if keys := collect(""); keys != "a*,a/1,a/2,b/1,c" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
@@ -0,0 +1,312 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/kildevaeld/keyval"
+)
+
+var (
+	_ keyval.KeyValStore            = (*store)(nil)
+	_ keyval.KeyValStoreContext     = (*store)(nil)
+	_ keyval.KeyValMetaStore        = (*store)(nil)
+	_ keyval.KeyValMetaStoreContext = (*store)(nil)
+)
+
+const DefaultRegion = "us-east-1"
+
+type S3Options struct {
+	// Endpoint of an S3-compatible service, or empty for AWS
+	Endpoint string `json:"endpoint,omitempty"`
+	Bucket   string `json:"bucket"`
+	// Prefix is prepended to all keys
+	Prefix string `json:"prefix,omitempty"`
+	Region string `json:"region,omitempty"`
+	// Credentials are read from the environment, unless AccessKey is set
+	AccessKey    string `json:"access_key,omitempty" mapstructure:"access_key"`
+	SecretKey    string `json:"secret_key,omitempty" mapstructure:"secret_key"`
+	SessionToken string `json:"session_token,omitempty" mapstructure:"session_token"`
+	// PathStyle addresses buckets as endpoint/bucket instead of bucket.endpoint
+	PathStyle bool `json:"path_style,omitempty" mapstructure:"path_style"`
+	// PartSize is the size of multipart upload parts. Streams smaller
+	// than a part are uploaded with a single request.
+	PartSize int64 `json:"part_size,omitempty" mapstructure:"part_size"`
+}
+
+type store struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+	prefix   string
+	// pageSize limits the keys listed per request, if set
+	pageSize int32
+}
+
+func (s *store) object(key []byte) *string {
+	return aws.String(s.prefix + string(key))
+}
+
+func (s *store) Set(key []byte, reader io.Reader) error {
+	return s.SetContext(context.Background(), key, reader)
+}
+
+// SetContext streams reader to the bucket, using a multipart upload
+// once it exceeds a single part.
+func (s *store) SetContext(ctx context.Context, key []byte, reader io.Reader) error {
+	if len(key) == 0 {
+		return keyval.ErrInvalidKey
+	}
+	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    s.object(key),
+		Body:   reader,
+	})
+	return err
+}
+
+func (s *store) SetBytes(key []byte, bs []byte) error {
+	return s.SetContext(context.Background(), key, bytes.NewReader(bs))
+}
+
+func (s *store) SetBytesContext(ctx context.Context, key []byte, bs []byte) error {
+	return s.SetContext(ctx, key, bytes.NewReader(bs))
+}
+
+func (s *store) Has(key []byte) (bool, error) {
+	return s.HasContext(context.Background(), key)
+}
+
+func (s *store) HasContext(ctx context.Context, key []byte) (bool, error) {
+	_, err := s.StatContext(ctx, key)
+	if errors.Is(err, keyval.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *store) Remove(key []byte) (bool, error) {
+	return s.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext checks the object exists first, as deleting a missing
+// object is not an error in S3.
+func (s *store) RemoveContext(ctx context.Context, key []byte) (bool, error) {
+	if has, err := s.HasContext(ctx, key); err != nil || !has {
+		return false, err
+	}
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    s.object(key),
+	})
+	return err == nil, err
+}
+
+func (s *store) Get(key []byte) (io.ReadCloser, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+func (s *store) GetContext(ctx context.Context, key []byte) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    s.object(key),
+	})
+	if err != nil {
+		return nil, toError(err)
+	}
+	return out.Body, nil
+}
+
+func (s *store) GetBytes(key []byte) ([]byte, error) {
+	return s.GetBytesContext(context.Background(), key)
+}
+
+func (s *store) GetBytesContext(ctx context.Context, key []byte) ([]byte, error) {
+	reader, err := s.GetContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func (s *store) Stat(key []byte) (keyval.Stat, error) {
+	return s.StatContext(context.Background(), key)
+}
+
+// StatContext reads the stat with HeadObject. S3 does not keep creation
+// times, so ctime is the time of the last write as well.
+func (s *store) StatContext(ctx context.Context, key []byte) (keyval.Stat, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    s.object(key),
+	})
+	if err != nil {
+		return nil, toError(err)
+	}
+
+	meta := keyval.Metadata{}
+	for name, value := range out.Metadata {
+		meta.Set(name, value)
+	}
+	if out.ContentType != nil {
+		meta.Set(keyval.MetaContentType, *out.ContentType)
+	}
+	if out.ContentEncoding != nil {
+		meta.Set(keyval.MetaContentEncoding, *out.ContentEncoding)
+	}
+
+	mtime := aws.ToTime(out.LastModified)
+	return keyval.NewStateMetadata(aws.ToInt64(out.ContentLength), etagHash(out.ETag), mtime, mtime, time.Time{}, meta), nil
+}
+
+func (s *store) List(prefix []byte, fn func(key []byte, meta keyval.Stat) error) error {
+	return s.ListContext(context.Background(), prefix, fn)
+}
+
+// ListContext pages through the objects under the literal part of prefix.
+// S3 lists keys in ascending order.
+func (s *store) ListContext(ctx context.Context, prefix []byte, fn func(key []byte, meta keyval.Stat) error) error {
+	match, err := keyval.Matcher(prefix)
+	if err != nil {
+		return err
+	}
+
+	prefix = keyval.LiteralPrefix(prefix)
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: s.object(prefix),
+	}
+	if s.pageSize > 0 {
+		input.MaxKeys = aws.Int32(s.pageSize)
+	}
+	pages := s3.NewListObjectsV2Paginator(s.client, input)
+
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return toError(err)
+		}
+
+		for _, object := range page.Contents {
+			key := []byte(strings.TrimPrefix(aws.ToString(object.Key), s.prefix))
+			if !match(key) {
+				continue
+			}
+
+			mtime := aws.ToTime(object.LastModified)
+			stat := keyval.NewState(aws.ToInt64(object.Size), etagHash(object.ETag), mtime, mtime)
+			if err := fn(key, stat); err != nil {
+				if errors.Is(err, keyval.ErrStopIter) {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// etagHash returns the ETag as the hash of a value. The ETag of a
+// multipart upload is not a plain hex digest, and is used verbatim.
+func etagHash(etag *string) []byte {
+	tag := strings.Trim(aws.ToString(etag), "\"")
+	if bs, err := hex.DecodeString(tag); err == nil {
+		return bs
+	}
+	return []byte(tag)
+}
+
+// toError maps missing objects onto keyval.ErrNotFound
+func toError(err error) error {
+	var (
+		noSuchKey *types.NoSuchKey
+		notFound  *types.NotFound
+		apiError  smithy.APIError
+	)
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return keyval.ErrNotFound
+	}
+	if errors.As(err, &apiError) && apiError.ErrorCode() == "NotFound" {
+		return keyval.ErrNotFound
+	}
+	return err
+}
+
+func init() {
+	keyval.Register("s3", func(options interface{}) (keyval.KeyValStore, error) {
+		if options == nil {
+			return nil, fmt.Errorf("S3 store needs a bucket parameter")
+		}
+
+		var (
+			o  S3Options
+			ok bool
+		)
+
+		if o, ok = options.(S3Options); !ok {
+			if err := keyval.GetOptions(options, &o); err != nil {
+				return nil, err
+			}
+		}
+
+		if o.Bucket == "" {
+			return nil, errors.New("bucket cannot be empty")
+		}
+		if o.Region == "" {
+			o.Region = DefaultRegion
+		}
+		if o.PartSize == 0 {
+			o.PartSize = manager.DefaultUploadPartSize
+		} else if o.PartSize < manager.MinUploadPartSize {
+			return nil, fmt.Errorf("part size must be at least %d bytes", manager.MinUploadPartSize)
+		}
+
+		loaders := []func(*config.LoadOptions) error{config.WithRegion(o.Region)}
+		if o.AccessKey != "" {
+			loaders = append(loaders, config.WithCredentialsProvider(
+				credentials.NewStaticCredentialsProvider(o.AccessKey, o.SecretKey, o.SessionToken),
+			))
+		}
+
+		cfg, err := config.LoadDefaultConfig(context.Background(), loaders...)
+		if err != nil {
+			return nil, err
+		}
+
+		client := s3.NewFromConfig(cfg, func(so *s3.Options) {
+			if o.Endpoint != "" {
+				so.BaseEndpoint = aws.String(o.Endpoint)
+				// Not all S3-compatible services support the default checksums
+				so.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+				so.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+			}
+			so.UsePathStyle = o.PathStyle
+		})
+
+		return &store{
+			client: client,
+			uploader: manager.NewUploader(client, func(u *manager.Uploader) {
+				u.PartSize = o.PartSize
+			}),
+			bucket: o.Bucket,
+			prefix: o.Prefix,
+		}, nil
+	})
+}
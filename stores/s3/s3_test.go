@@ -0,0 +1,132 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/kildevaeld/keyval"
+)
+
+func newStore(t *testing.T, prefix string) (*store, func()) {
+	backend := s3mem.New()
+	if err := backend.CreateBucket("test"); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(gofakes3.New(backend).Server())
+
+	s, err := keyval.Store("s3", map[string]interface{}{
+		"endpoint":   server.URL,
+		"bucket":     "test",
+		"prefix":     prefix,
+		"access_key": "key",
+		"secret_key": "secret",
+		"path_style": true,
+	})
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return s.(*store), server.Close
+}
+
+func TestSet(t *testing.T) {
+	s, done := newStore(t, "kv/")
+	defer done()
+
+	if err := s.Set([]byte("key"), strings.NewReader("value")); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := s.GetBytes([]byte("key")); err != nil || string(bs) != "value" {
+		t.Fatalf("expected value, got %q %v", bs, err)
+	}
+
+	stat, err := s.Stat([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != 5 || len(stat.Hash()) == 0 {
+		t.Fatalf("unexpected stat: %d %x", stat.Size(), stat.Hash())
+	}
+
+	if has, _ := s.Has([]byte("missing")); has {
+		t.Fatal("expected missing key")
+	}
+	if _, err := s.Get([]byte("missing")); err != keyval.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.Stat([]byte("missing")); err != keyval.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if removed, err := s.Remove([]byte("key")); err != nil || !removed {
+		t.Fatalf("expected key to be removed: %v", err)
+	}
+	if removed, _ := s.Remove([]byte("key")); removed {
+		t.Fatal("expected key to be removed once")
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	s, done := newStore(t, "")
+	defer done()
+
+	value := make([]byte, 11<<20)
+	rand.Read(value)
+
+	// Hide the length, so the upload has to be streamed
+	if err := s.Set([]byte("large"), struct{ *bytes.Reader }{bytes.NewReader(value)}); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := s.GetBytes([]byte("large"))
+	if err != nil || !bytes.Equal(bs, value) {
+		t.Fatalf("value does not match: %v", err)
+	}
+
+	stat, err := s.Stat([]byte("large"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != int64(len(value)) {
+		t.Fatalf("expected size %d, got %d", len(value), stat.Size())
+	}
+}
+
+func TestList(t *testing.T) {
+	s, done := newStore(t, "kv/")
+	defer done()
+
+	for _, k := range []string{"b/1", "a/2", "a/1", "c"} {
+		s.SetBytes([]byte(k), []byte(k))
+	}
+
+	// Pagination is exercised with pages of one key
+	s.pageSize = 1
+
+	collect := func(prefix string) string {
+		var keys []string
+		err := s.List([]byte(prefix), func(key []byte, meta keyval.Stat) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, ",")
+	}
+
+	if keys := collect("a/"); keys != "a/1,a/2" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if keys := collect("*/1"); keys != "a/1,b/1" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if keys := collect(""); keys != "a/1,a/2,b/1,c" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
@@ -0,0 +1,537 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+
+	system "github.com/kildevaeld/go-system"
+	"github.com/kildevaeld/keyval"
+	_ "modernc.org/sqlite"
+)
+
+var (
+	_ keyval.KeyValStore            = (*store)(nil)
+	_ keyval.KeyValStoreContext     = (*store)(nil)
+	_ keyval.KeyValMetaStore        = (*store)(nil)
+	_ keyval.KeyValMetaStoreContext = (*store)(nil)
+	_ keyval.MetadataStore          = (*store)(nil)
+)
+
+const DefaultChunkSize = 1 << 20
+
+var (
+	ErrTTLUnsupported = keyval.ErrTTLUnsupported
+
+	errStagingLost = errors.New("staged chunks were removed")
+
+	validTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// The stat index covers all columns but the value, so Stat and List
+// never read values. The driver does not expose SQLite's incremental
+// blob API, so values larger than a chunk are kept in the chunks table
+// instead, with a NULL value column, and read and written a chunk at
+// a time.
+const schema = `
+CREATE TABLE IF NOT EXISTS %[1]s (
+	key      BLOB PRIMARY KEY,
+	value    BLOB,
+	size     INTEGER NOT NULL,
+	hash     BLOB,
+	ctime    INTEGER NOT NULL,
+	mtime    INTEGER NOT NULL,
+	metadata TEXT
+);
+CREATE INDEX IF NOT EXISTS %[1]s_stat ON %[1]s (key, size, hash, ctime, mtime, metadata);
+CREATE TABLE IF NOT EXISTS %[1]s_chunks (
+	key  BLOB NOT NULL,
+	seq  INTEGER NOT NULL,
+	data BLOB NOT NULL,
+	PRIMARY KEY (key, seq)
+);`
+
+type SQLiteOptions struct {
+	Path      string `json:"path"`
+	Table     string `json:"table,omitempty"`
+	ChunkSize int    `json:"chunk_size,omitempty" mapstructure:"chunk_size"`
+	Hash      string `json:"hash,omitempty"`
+}
+
+type store struct {
+	db        *sql.DB
+	table     string
+	chunkSize int
+	hash      string
+}
+
+func (s *store) Set(key []byte, reader io.Reader) error {
+	return s.SetContext(context.Background(), key, reader)
+}
+
+func (s *store) SetContext(ctx context.Context, key []byte, reader io.Reader) error {
+	return s.set(ctx, key, reader, nil, nil)
+}
+
+func (s *store) SetBytes(key []byte, bs []byte) error {
+	return s.SetContext(context.Background(), key, bytes.NewReader(bs))
+}
+
+func (s *store) SetBytesContext(ctx context.Context, key []byte, bs []byte) error {
+	return s.SetContext(ctx, key, bytes.NewReader(bs))
+}
+
+func (s *store) SetWithOptions(ctx context.Context, key []byte, reader io.Reader, options keyval.SetOptions) error {
+	if options.TTL > 0 {
+		return ErrTTLUnsupported
+	}
+	return s.set(ctx, key, reader, options.Metadata, options.Condition)
+}
+
+// stagingKey keeps chunks while they are written. It is text, and so
+// never equal to the key of a value, which are blobs.
+const stagingKey = ""
+
+// set writes values larger than a chunk to staged chunks first, outside
+// of any transaction, so the write lock is not held while the value is
+// read. The chunks are then moved to the key in a single transaction,
+// which replaces the old value atomically.
+func (s *store) set(ctx context.Context, key []byte, reader io.Reader, meta keyval.Metadata, cond keyval.Condition) error {
+	if len(key) == 0 {
+		return keyval.ErrInvalidKey
+	}
+
+	var metadata interface{}
+	if len(meta) > 0 {
+		bs, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		metadata = string(bs)
+	}
+
+	hash, err := keyval.NewHash(s.hash)
+	if err != nil {
+		return err
+	}
+
+	reader = keyval.NewContextReader(ctx, reader)
+
+	var (
+		value     []byte
+		size      int64
+		base      int64
+		chunks    int64
+		committed bool
+	)
+	defer func() {
+		if chunks > 0 && !committed {
+			s.db.Exec(s.query("DELETE FROM %s_chunks WHERE key = ? AND seq >= ? AND seq < ?"), stagingKey, base, base+chunks)
+		}
+	}()
+
+	for {
+		buf := make([]byte, s.chunkSize)
+		n, err := io.ReadFull(reader, buf)
+		hash.Write(buf[:n])
+		size += int64(n)
+
+		if chunks == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			// The value fits in the table
+			value = buf[:n]
+			break
+		}
+
+		if n > 0 {
+			if chunks == 0 {
+				base = stagingBase()
+			}
+			if _, err := s.db.ExecContext(ctx, s.query("INSERT INTO %s_chunks (key, seq, data) VALUES (?, ?, ?)"), stagingKey, base+chunks, buf[:n]); err != nil {
+				return err
+			}
+			chunks++
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if cond != nil {
+		current, err := s.stat(ctx, tx, key)
+		if errors.Is(err, keyval.ErrNotFound) {
+			current = nil
+		} else if err != nil {
+			return err
+		}
+		if err := cond(current); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, s.query("DELETE FROM %s_chunks WHERE key = ?"), key); err != nil {
+		return err
+	}
+
+	if chunks > 0 {
+		result, err := tx.ExecContext(ctx, s.query("UPDATE %s_chunks SET key = ?, seq = seq - ? WHERE key = ? AND seq >= ? AND seq < ?"),
+			key, base, stagingKey, base, base+chunks)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n != chunks {
+			return errStagingLost
+		}
+	}
+
+	now := time.Now().UnixNano()
+	_, err = tx.ExecContext(ctx, s.query(`INSERT INTO %s (key, value, size, hash, ctime, mtime, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			value = excluded.value, size = excluded.size, hash = excluded.hash,
+			mtime = excluded.mtime, metadata = excluded.metadata`),
+		key, value, size, hash.Sum(nil), now, now, metadata)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// stagingBase returns the first sequence number of staged chunks. Bases
+// are random, so concurrent writes stage their chunks apart.
+func stagingBase() int64 {
+	var b [8]byte
+	rand.Read(b[:])
+	// Leave room for the chunks following the base
+	return int64(binary.LittleEndian.Uint64(b[:]) >> 2)
+}
+
+func (s *store) Has(key []byte) (bool, error) {
+	return s.HasContext(context.Background(), key)
+}
+
+func (s *store) HasContext(ctx context.Context, key []byte) (bool, error) {
+	var one int
+	err := s.db.QueryRowContext(ctx, s.query("SELECT 1 FROM %[1]s INDEXED BY %[1]s_stat WHERE key = ?"), key).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *store) Remove(key []byte) (bool, error) {
+	return s.RemoveContext(context.Background(), key)
+}
+
+func (s *store) RemoveContext(ctx context.Context, key []byte) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, s.query("DELETE FROM %s WHERE key = ?"), key)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, s.query("DELETE FROM %s_chunks WHERE key = ?"), key); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *store) Get(key []byte) (io.ReadCloser, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext returns values kept in the table directly. Chunked values
+// are read a chunk at a time from a read transaction, which is kept
+// open until the reader is closed.
+func (s *store) GetContext(ctx context.Context, key []byte) (io.ReadCloser, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		chunked bool
+		value   []byte
+	)
+	err = tx.QueryRowContext(ctx, s.query("SELECT value IS NULL, value FROM %s WHERE key = ?"), key).Scan(&chunked, &value)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, keyval.ErrNotFound
+		}
+		return nil, err
+	}
+
+	if !chunked {
+		tx.Rollback()
+		return ioutil.NopCloser(bytes.NewReader(value)), nil
+	}
+
+	return &chunkReader{ctx: ctx, tx: tx, query: s.query("SELECT data FROM %s_chunks WHERE key = ? AND seq = ?"), key: key}, nil
+}
+
+func (s *store) GetBytes(key []byte) ([]byte, error) {
+	return s.GetBytesContext(context.Background(), key)
+}
+
+func (s *store) GetBytesContext(ctx context.Context, key []byte) ([]byte, error) {
+	reader, err := s.GetContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func (s *store) Stat(key []byte) (keyval.Stat, error) {
+	return s.StatContext(context.Background(), key)
+}
+
+func (s *store) StatContext(ctx context.Context, key []byte) (keyval.Stat, error) {
+	return s.stat(ctx, s.db, key)
+}
+
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s *store) stat(ctx context.Context, q queryer, key []byte) (keyval.Stat, error) {
+	row := q.QueryRowContext(ctx, s.query("SELECT size, hash, ctime, mtime, metadata FROM %[1]s INDEXED BY %[1]s_stat WHERE key = ?"), key)
+	stat, err := scanStat(row)
+	if err == sql.ErrNoRows {
+		return nil, keyval.ErrNotFound
+	}
+	return stat, err
+}
+
+func (s *store) List(prefix []byte, fn func(key []byte, meta keyval.Stat) error) error {
+	return s.ListContext(context.Background(), prefix, fn)
+}
+
+// ListContext queries the stat index for the literal part of prefix.
+// Rows are read before fn is called, so fn is free to modify the store.
+func (s *store) ListContext(ctx context.Context, prefix []byte, fn func(key []byte, meta keyval.Stat) error) error {
+	match, err := keyval.Matcher(prefix)
+	if err != nil {
+		return err
+	}
+
+	prefix = keyval.LiteralPrefix(prefix)
+
+	// A nil prefix would bind as NULL, which no key compares to
+	query := s.query("SELECT key, size, hash, ctime, mtime, metadata FROM %[1]s INDEXED BY %[1]s_stat WHERE key >= ?")
+	args := []interface{}{append([]byte{}, prefix...)}
+	if end := keyval.Successor(prefix); end != nil {
+		query += " AND key < ?"
+		args = append(args, end)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY key", args...)
+	if err != nil {
+		return err
+	}
+
+	type item struct {
+		key  []byte
+		stat keyval.Stat
+	}
+	var items []item
+	for rows.Next() {
+		var key []byte
+		stat, err := scanStat(rows, &key)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if match(key) {
+			items = append(items, item{key, stat})
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(item.key, item.stat); err != nil {
+			if errors.Is(err, keyval.ErrStopIter) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *store) Close() error {
+	return s.db.Close()
+}
+
+// query inserts the table name into query
+func (s *store) query(query string) string {
+	return fmt.Sprintf(query, s.table)
+}
+
+// scanStat scans a stat, after any leading columns given in dest.
+func scanStat(row interface{ Scan(...interface{}) error }, dest ...interface{}) (keyval.Stat, error) {
+	var (
+		size         int64
+		hash         []byte
+		ctime, mtime int64
+		metadata     sql.NullString
+	)
+	if err := row.Scan(append(dest, &size, &hash, &ctime, &mtime, &metadata)...); err != nil {
+		return nil, err
+	}
+
+	var meta keyval.Metadata
+	if metadata.Valid {
+		if err := json.Unmarshal([]byte(metadata.String), &meta); err != nil {
+			return nil, err
+		}
+	}
+
+	return keyval.NewStateMetadata(size, hash, time.Unix(0, ctime), time.Unix(0, mtime), time.Time{}, meta), nil
+}
+
+type chunkReader struct {
+	ctx   context.Context
+	tx    *sql.Tx
+	query string
+	key   []byte
+	seq   int64
+	buf   []byte
+	eof   bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		err := c.tx.QueryRowContext(c.ctx, c.query, c.key, c.seq).Scan(&c.buf)
+		if err == sql.ErrNoRows {
+			c.eof = true
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		c.seq++
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkReader) Close() error {
+	return c.tx.Rollback()
+}
+
+func init() {
+	keyval.Register("sqlite", func(options interface{}) (keyval.KeyValStore, error) {
+		if options == nil {
+			return nil, fmt.Errorf("SQLite store needs a path parameter")
+		}
+
+		var (
+			o  SQLiteOptions
+			ok bool
+		)
+
+		if o, ok = options.(SQLiteOptions); !ok {
+			if err := keyval.GetOptions(options, &o); err != nil {
+				return nil, err
+			}
+		}
+
+		if o.Path == "" {
+			return nil, errors.New("path cannot be empty")
+		}
+		if o.Table == "" {
+			o.Table = "keyval"
+		}
+		if !validTable.MatchString(o.Table) {
+			return nil, fmt.Errorf("invalid table name: %s", o.Table)
+		}
+		if o.ChunkSize <= 0 {
+			o.ChunkSize = DefaultChunkSize
+		}
+		if !keyval.ValidHash(o.Hash) {
+			return nil, fmt.Errorf("invalid hash algorithm: %s", o.Hash)
+		}
+
+		o.Path = system.Environ(os.Environ()).Expand(o.Path)
+
+		// Writes take the write lock up front, so transactions reading
+		// before they write cannot deadlock. The path is escaped, as
+		// SQLite decodes it from the URI.
+		dsn := "file:" + (&url.URL{Path: o.Path}).EscapedPath() + "?" + url.Values{
+			"_pragma": {"journal_mode(WAL)", "busy_timeout(10000)"},
+			"_txlock": {"immediate"},
+		}.Encode()
+
+		db, err := sql.Open("sqlite", dsn)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := db.Exec(fmt.Sprintf(schema, o.Table)); err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		// Chunks staged by writes, which were interrupted by a crash
+		if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s_chunks WHERE key = ?", o.Table), stagingKey); err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		return &store{
+			db:        db,
+			table:     o.Table,
+			chunkSize: o.ChunkSize,
+			hash:      o.Hash,
+		}, nil
+	})
+}
@@ -0,0 +1,281 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kildevaeld/keyval"
+)
+
+func newStore(t *testing.T, options map[string]interface{}) (*store, func()) {
+	dir, err := ioutil.TempDir("", "keyval-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options["path"] = filepath.Join(dir, "store.db")
+
+	s, err := keyval.Store("sqlite", options)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return s.(*store), func() {
+		s.(*store).Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSet(t *testing.T) {
+	s, done := newStore(t, map[string]interface{}{"chunk_size": 4})
+	defer done()
+
+	for _, value := range []string{"", "abc", "abcd", "a value spanning several chunks"} {
+		if err := s.Set([]byte("key"), strings.NewReader(value)); err != nil {
+			t.Fatal(err)
+		}
+		bs, err := s.GetBytes([]byte("key"))
+		if err != nil || string(bs) != value {
+			t.Fatalf("expected %q, got %q %v", value, bs, err)
+		}
+		stat, err := s.Stat([]byte("key"))
+		if err != nil || stat.Size() != int64(len(value)) {
+			t.Fatalf("unexpected stat for %q: %v", value, err)
+		}
+	}
+
+	var chunks int
+	s.db.QueryRow("SELECT count(*) FROM keyval_chunks").Scan(&chunks)
+	if chunks != 8 {
+		t.Fatalf("expected 8 chunks, got %d", chunks)
+	}
+
+	// Readers keep their snapshot while the value is replaced
+	reader, err := s.Get([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetBytes([]byte("key"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(bs) != "a value spanning several chunks" {
+		t.Fatalf("expected old value, got %q", bs)
+	}
+
+	if removed, err := s.Remove([]byte("key")); err != nil || !removed {
+		t.Fatalf("expected key to be removed: %v", err)
+	}
+	if has, _ := s.Has([]byte("key")); has {
+		t.Fatal("expected key to be gone")
+	}
+	if _, err := s.Get([]byte("key")); err != keyval.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestStaging(t *testing.T) {
+	s, done := newStore(t, map[string]interface{}{"chunk_size": 4})
+	defer done()
+
+	// A value being read holds no lock, so other writes go ahead
+	pr, pw := io.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Set([]byte("slow"), pr)
+	}()
+	pw.Write([]byte("a value spanning"))
+
+	written := make(chan error, 1)
+	go func() {
+		written <- s.SetBytes([]byte("fast"), []byte("a value spanning several chunks"))
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected write to proceed while another value is read")
+	}
+
+	pw.Write([]byte(" several chunks"))
+	pw.Close()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := s.GetBytes([]byte("slow")); string(bs) != "a value spanning several chunks" {
+		t.Fatalf("unexpected value %q", bs)
+	}
+
+	// Chunks of a failed write are dropped
+	pr, pw = io.Pipe()
+	go func() {
+		pw.Write([]byte("a partial value"))
+		pw.CloseWithError(errors.New("broken"))
+	}()
+	if err := s.Set([]byte("slow"), pr); err == nil {
+		t.Fatal("expected write to fail")
+	}
+	if bs, _ := s.GetBytes([]byte("slow")); string(bs) != "a value spanning several chunks" {
+		t.Fatalf("expected old value, got %q", bs)
+	}
+
+	var staged int
+	s.db.QueryRow("SELECT count(*) FROM keyval_chunks WHERE key = ''").Scan(&staged)
+	if staged != 0 {
+		t.Fatalf("expected no staged chunks, got %d", staged)
+	}
+
+	if err := s.SetWithOptions(context.Background(), []byte("key"), strings.NewReader("value"), keyval.SetOptions{TTL: time.Minute}); !errors.Is(err, keyval.ErrTTLUnsupported) {
+		t.Fatalf("expected ErrTTLUnsupported, got %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	s, done := newStore(t, map[string]interface{}{"table": "files"})
+	defer done()
+
+	meta := keyval.Metadata{keyval.MetaContentType: "text/plain"}
+	if err := s.SetWithOptions(context.Background(), []byte("key"), strings.NewReader("hello"), keyval.SetOptions{Metadata: meta}); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := s.Stat([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stat.Metadata(), meta) {
+		t.Fatalf("expected %v, got %v", meta, stat.Metadata())
+	}
+
+	// Conditions are checked within the write
+	err = s.SetWithOptions(context.Background(), []byte("key"), strings.NewReader("bye"), keyval.SetOptions{Condition: keyval.IfNotExists})
+	if err != keyval.ErrExists {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	err = s.SetWithOptions(context.Background(), []byte("key"), strings.NewReader("bye"), keyval.SetOptions{Condition: keyval.IfMatch(stat.Hash())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := s.GetBytes([]byte("key")); !bytes.Equal(bs, []byte("bye")) {
+		t.Fatalf("expected bye, got %q", bs)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	s, done := newStore(t, map[string]interface{}{"chunk_size": 4})
+	defer done()
+
+	// The generic fallback rewrites the value, keeping its metadata
+	meta := keyval.Metadata{keyval.MetaContentType: "text/plain"}
+	if err := s.SetWithOptions(context.Background(), []byte("key"), strings.NewReader("hello"), keyval.SetOptions{Metadata: meta}); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyval.Append(s, []byte("key"), strings.NewReader(" world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyval.WriteAt(s, []byte("key"), 0, strings.NewReader("H")); err != nil {
+		t.Fatal(err)
+	}
+
+	if bs, _ := s.GetBytes([]byte("key")); string(bs) != "Hello world" {
+		t.Fatalf("expected Hello world, got %q", bs)
+	}
+	stat, err := s.Stat([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stat.Metadata(), meta) {
+		t.Fatalf("expected %v, got %v", meta, stat.Metadata())
+	}
+
+	if err := keyval.Append(s, []byte("new"), strings.NewReader("value")); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := s.GetBytes([]byte("new")); string(bs) != "value" {
+		t.Fatalf("expected value, got %q", bs)
+	}
+}
+
+func TestPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyval-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Characters with a meaning in URIs are part of the path
+	path := filepath.Join(dir, "store?v=1#%20.db")
+	s, err := keyval.Store("sqlite", map[string]interface{}{"path": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.(*store).Close()
+
+	if err := s.SetBytes([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The options following the path are applied
+	var mode string
+	s.(*store).db.QueryRow("PRAGMA journal_mode").Scan(&mode)
+	if mode != "wal" {
+		t.Fatalf("expected wal journal mode, got %q", mode)
+	}
+}
+
+func TestList(t *testing.T) {
+	s, done := newStore(t, map[string]interface{}{})
+	defer done()
+
+	for _, k := range []string{"b/1", "a/2", "a/1", "c"} {
+		s.SetBytes([]byte(k), []byte(k))
+	}
+
+	collect := func(prefix string) string {
+		var keys []string
+		err := s.List([]byte(prefix), func(key []byte, meta keyval.Stat) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, ",")
+	}
+
+	if keys := collect("a/"); keys != "a/1,a/2" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if keys := collect("*/1"); keys != "a/1,b/1" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if keys := collect(""); keys != "a/1,a/2,b/1,c" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	var count int
+	if err := s.List(nil, func(key []byte, meta keyval.Stat) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Fatalf("expected a nil prefix to list 4 keys, got %d", count)
+	}
+}
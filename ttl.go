@@ -0,0 +1,99 @@
+package keyval
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TTLStore is implemented by stores supporting expiring values.
+// A ttl <= 0 stores the value without expiry.
+type TTLStore interface {
+	SetWithTTL(key []byte, reader io.Reader, ttl time.Duration) error
+	SetBytesWithTTL(key []byte, bytes []byte, ttl time.Duration) error
+}
+
+// Expirer is implemented by stores, which can purge expired values.
+// Expired values are never returned from a store, but may occupy
+// space until RemoveExpired is called.
+type Expirer interface {
+	RemoveExpired() (int, error)
+}
+
+// Expired reports whether a value with the given expiry time has expired.
+func Expired(expires time.Time, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
+
+// ExpiresAt returns the expiry time of a value written now with ttl.
+func ExpiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// Reaper periodically removes expired values from a store.
+type Reaper struct {
+	store    Expirer
+	interval time.Duration
+	lock     sync.Mutex
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewReaper(store Expirer, interval time.Duration) *Reaper {
+	return &Reaper{store: store, interval: interval}
+}
+
+// Start starts the reaper. Calling Start on a running reaper does nothing.
+func (r *Reaper) Start() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.stop != nil {
+		return
+	}
+
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go r.run(r.stop, r.done)
+}
+
+// Stop stops the reaper and waits for a running sweep to finish.
+func (r *Reaper) Stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.stop == nil {
+		return
+	}
+
+	close(r.stop)
+	<-r.done
+	r.stop, r.done = nil, nil
+}
+
+func (r *Reaper) run(stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			n, err := r.store.RemoveExpired()
+			if err != nil {
+				zap.L().Sugar().Errorf("Could not remove expired values: %s", err)
+			} else if n > 0 {
+				zap.L().Sugar().Debugf("Removed %d expired values", n)
+			}
+		}
+	}
+}
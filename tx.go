@@ -0,0 +1,20 @@
+package keyval
+
+import "errors"
+
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// Tx is a view of a store, where changes are only applied on Commit.
+// Reads see the transaction's own writes, and values read are checked
+// to be unchanged on Commit, which otherwise fails with ErrConflict.
+// A Tx must not be used from multiple goroutines.
+type Tx interface {
+	KeyValStore
+	Commit() error
+	Rollback() error
+}
+
+// Transactional is implemented by stores supporting multi-key transactions.
+type Transactional interface {
+	Begin() (Tx, error)
+}
@@ -0,0 +1,44 @@
+package keyval
+
+import (
+	"bytes"
+	"path/filepath"
+)
+
+// KeyValidator is implemented by stores which restrict the keys they accept.
+type KeyValidator interface {
+	ValidateKey(key []byte) error
+}
+
+// ValidateKey validates key against store, if the store implements
+// KeyValidator. Empty keys are never valid.
+func ValidateKey(store interface{}, key []byte) error {
+	if len(key) == 0 {
+		return ErrInvalidKey
+	}
+	if v, ok := store.(KeyValidator); ok {
+		return v.ValidateKey(key)
+	}
+	return nil
+}
+
+// ValidatePathKey checks that key is safe to use as a relative path.
+// Keys must consist of non-empty, slash separated segments, which
+// are not "." or "..", and must not contain NUL bytes or backslashes.
+func ValidatePathKey(key []byte) error {
+	if len(key) == 0 || bytes.IndexByte(key, 0) >= 0 || bytes.IndexByte(key, '\\') >= 0 {
+		return ErrInvalidKey
+	}
+
+	if filepath.IsAbs(string(key)) || filepath.VolumeName(string(key)) != "" {
+		return ErrInvalidKey
+	}
+
+	for _, segment := range bytes.Split(key, []byte("/")) {
+		if len(segment) == 0 || bytes.Equal(segment, []byte(".")) || bytes.Equal(segment, []byte("..")) {
+			return ErrInvalidKey
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,350 @@
+package keyval
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VersionPrefix is where the versioning wrapper keeps old versions.
+// Keys with this prefix are rejected by the wrapper. It differs from the
+// directory the filesystem store keeps its own versions in, which that
+// store reserves.
+const VersionPrefix = "__keyval_versions/"
+
+type Version struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"`
+	Hash    []byte    `json:"hash,omitempty"`
+}
+
+// Retention limits the versions kept for each key. The newest version is
+// always kept. The zero value keeps all versions.
+type Retention struct {
+	// Keep is the maximum number of versions kept, or 0 for no limit
+	Keep int `json:"keep,omitempty"`
+	// Days is the number of days versions are kept, or 0 for ever.
+	// Versions are only dropped when their key is written.
+	Days int `json:"days,omitempty"`
+}
+
+// Apply splits versions, ordered newest first, into the versions to keep
+// and the versions to drop.
+func (r Retention) Apply(versions []Version, now time.Time) (keep []Version, drop []Version) {
+	for i, v := range versions {
+		tooMany := r.Keep > 0 && i >= r.Keep
+		tooOld := r.Days > 0 && now.Sub(v.Created) > time.Duration(r.Days)*24*time.Hour
+		if i > 0 && (tooMany || tooOld) {
+			drop = append(drop, v)
+		} else {
+			keep = append(keep, v)
+		}
+	}
+	return keep, drop
+}
+
+// VersionedStore is implemented by stores keeping old values. Every write
+// creates a new version, and removing a key keeps its versions.
+type VersionedStore interface {
+	// Versions returns the versions of key, newest first
+	Versions(key []byte) ([]Version, error)
+	GetVersion(key []byte, id string) (io.ReadCloser, error)
+	// Restore writes the value of version id as a new version
+	Restore(key []byte, id string) error
+}
+
+// NewVersionID returns an id, which sorts by t.
+func NewVersionID(t time.Time) string {
+	var r [4]byte
+	rand.Read(r[:])
+	return fmt.Sprintf("%016x%s", t.UnixNano(), hex.EncodeToString(r[:]))
+}
+
+// Versioned returns store with versioning. Stores implementing
+// VersionedStore natively are returned as is. Otherwise old values are
+// kept in store below VersionPrefix, along with a manifest for each key.
+// The manifest is guarded by a lock in the wrapper, so a store must not
+// be versioned by more than one wrapper at a time.
+//
+// The wrapper implements KeyValStore and KeyValMetaStore, along with their
+// context aware variants. Other capabilities of store, such as TTLStore,
+// ConditionalStore or RangeStore, are hidden by it. Retention is applied
+// to the versions of a key when it is written, so versions older than
+// Retention.Days are kept until then.
+func Versioned(store KeyValStore, retention Retention) KeyValStore {
+	if _, ok := store.(VersionedStore); ok {
+		return store
+	}
+	v := &versioned{store: WithContext(store), retention: retention}
+	if meta, ok := store.(KeyValMetaStore); ok {
+		return &versionedMeta{v, WithMetaContext(meta)}
+	}
+	return v
+}
+
+type versioned struct {
+	store     KeyValStoreContext
+	retention Retention
+	lock      sync.Mutex
+	// last is the time of the last version allocated
+	last time.Time
+}
+
+func isVersionKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(VersionPrefix))
+}
+
+// versionDir keeps the versions of key. The ".v" suffix keeps the
+// directory of a key apart from versions and manifests of its parents.
+func versionDir(key []byte) string {
+	return VersionPrefix + string(key) + ".v/"
+}
+
+func versionKey(key []byte, id string) []byte {
+	return []byte(versionDir(key) + id)
+}
+
+func manifestKey(key []byte) []byte {
+	return []byte(versionDir(key) + "manifest")
+}
+
+func (v *versioned) Set(key []byte, reader io.Reader) error {
+	return v.SetContext(context.Background(), key, reader)
+}
+
+// SetContext writes the value as a new version, before taking the lock
+// to update the manifest. Writes of the same key may finish out of
+// order, so versions are ordered by their ids, which are allocated when
+// the write starts, and the current value is only replaced by the newest.
+func (v *versioned) SetContext(ctx context.Context, key []byte, reader io.Reader) error {
+	if len(key) == 0 || isVersionKey(key) {
+		return ErrInvalidKey
+	}
+
+	v.lock.Lock()
+	id, now, err := v.allocate(key)
+	v.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	hash, err := NewHash("")
+	if err != nil {
+		return err
+	}
+	counter := &countWriter{}
+
+	if err := v.store.SetContext(ctx, versionKey(key, id), io.TeeReader(reader, io.MultiWriter(hash, counter))); err != nil {
+		return err
+	}
+
+	// Once written, the version is committed regardless of ctx, so the
+	// current value and the manifest stay in step
+	ctx = context.Background()
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	versions, err := v.manifest(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].ID < id
+	})
+	if i == 0 {
+		value, err := v.store.GetContext(ctx, versionKey(key, id))
+		if err != nil {
+			return err
+		}
+		err = v.store.SetContext(ctx, key, value)
+		value.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	version := Version{ID: id, Created: now, Size: counter.n, Hash: hash.Sum(nil)}
+	versions = append(versions[:i:i], append([]Version{version}, versions[i:]...)...)
+
+	keep, drop := v.retention.Apply(versions, time.Now())
+	if err := v.saveManifest(key, keep); err != nil {
+		return err
+	}
+	for _, version := range drop {
+		if _, err := v.store.RemoveContext(ctx, versionKey(key, version.ID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// allocate returns the id and creation time of a new version of key.
+// The times increase even if the clock goes backwards, so the ids of
+// later writes sort after earlier ones. Callers must hold the lock.
+func (v *versioned) allocate(key []byte) (string, time.Time, error) {
+	versions, err := v.manifest(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", time.Time{}, err
+	}
+
+	// Without the monotonic reading, times compare as they are stored
+	now := time.Now().Round(0)
+	if len(versions) > 0 && !now.After(versions[0].Created) {
+		now = versions[0].Created.Add(1)
+	}
+	if !now.After(v.last) {
+		now = v.last.Add(1)
+	}
+	v.last = now
+
+	return NewVersionID(now), now, nil
+}
+
+func (v *versioned) SetBytes(key []byte, value []byte) error {
+	return v.SetContext(context.Background(), key, bytes.NewReader(value))
+}
+
+func (v *versioned) SetBytesContext(ctx context.Context, key []byte, value []byte) error {
+	return v.SetContext(ctx, key, bytes.NewReader(value))
+}
+
+func (v *versioned) Has(key []byte) (bool, error) {
+	return v.HasContext(context.Background(), key)
+}
+
+func (v *versioned) HasContext(ctx context.Context, key []byte) (bool, error) {
+	if isVersionKey(key) {
+		return false, ErrInvalidKey
+	}
+	return v.store.HasContext(ctx, key)
+}
+
+// Remove removes the current value, keeping its versions.
+func (v *versioned) Remove(key []byte) (bool, error) {
+	return v.RemoveContext(context.Background(), key)
+}
+
+func (v *versioned) RemoveContext(ctx context.Context, key []byte) (bool, error) {
+	if isVersionKey(key) {
+		return false, ErrInvalidKey
+	}
+	return v.store.RemoveContext(ctx, key)
+}
+
+func (v *versioned) Get(key []byte) (io.ReadCloser, error) {
+	return v.GetContext(context.Background(), key)
+}
+
+func (v *versioned) GetContext(ctx context.Context, key []byte) (io.ReadCloser, error) {
+	if isVersionKey(key) {
+		return nil, ErrInvalidKey
+	}
+	return v.store.GetContext(ctx, key)
+}
+
+func (v *versioned) GetBytes(key []byte) ([]byte, error) {
+	return v.GetBytesContext(context.Background(), key)
+}
+
+func (v *versioned) GetBytesContext(ctx context.Context, key []byte) ([]byte, error) {
+	if isVersionKey(key) {
+		return nil, ErrInvalidKey
+	}
+	return v.store.GetBytesContext(ctx, key)
+}
+
+func (v *versioned) Versions(key []byte) ([]Version, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.manifest(key)
+}
+
+// GetVersion returns the value of version id. Ids are only accepted if
+// they name a version, and not the manifest or another key.
+func (v *versioned) GetVersion(key []byte, id string) (io.ReadCloser, error) {
+	if id == "" || id == "manifest" || strings.ContainsAny(id, "/.") {
+		return nil, ErrNotFound
+	}
+	return v.store.GetContext(context.Background(), versionKey(key, id))
+}
+
+func (v *versioned) Restore(key []byte, id string) error {
+	value, err := v.GetVersion(key, id)
+	if err != nil {
+		return err
+	}
+	defer value.Close()
+	return v.Set(key, value)
+}
+
+// manifest returns the versions of key. Callers must hold the lock.
+func (v *versioned) manifest(key []byte) ([]Version, error) {
+	bs, err := v.store.GetBytesContext(context.Background(), manifestKey(key))
+	if err != nil {
+		return nil, err
+	}
+	var versions []Version
+	if err := json.Unmarshal(bs, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (v *versioned) saveManifest(key []byte, versions []Version) error {
+	bs, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	return v.store.SetBytesContext(context.Background(), manifestKey(key), bs)
+}
+
+type versionedMeta struct {
+	*versioned
+	meta KeyValMetaStoreContext
+}
+
+func (v *versionedMeta) Stat(key []byte) (Stat, error) {
+	return v.StatContext(context.Background(), key)
+}
+
+func (v *versionedMeta) StatContext(ctx context.Context, key []byte) (Stat, error) {
+	if isVersionKey(key) {
+		return nil, ErrInvalidKey
+	}
+	return v.meta.StatContext(ctx, key)
+}
+
+func (v *versionedMeta) List(prefix []byte, fn func(key []byte, meta Stat) error) error {
+	return v.ListContext(context.Background(), prefix, fn)
+}
+
+func (v *versionedMeta) ListContext(ctx context.Context, prefix []byte, fn func(key []byte, meta Stat) error) error {
+	return v.meta.ListContext(ctx, prefix, func(key []byte, meta Stat) error {
+		if isVersionKey(key) {
+			return nil
+		}
+		return fn(key, meta)
+	})
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
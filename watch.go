@@ -0,0 +1,117 @@
+package keyval
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+type EventType int
+
+const (
+	EventCreated EventType = iota + 1
+	EventUpdated
+	EventDeleted
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventCreated:
+		return "created"
+	case EventUpdated:
+		return "updated"
+	case EventDeleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+type Event struct {
+	Type EventType
+	Key  []byte
+}
+
+// Watcher is implemented by stores, which can notify about changes.
+// Watch emits events for keys matching prefix, which may be a glob as
+// accepted by List. The channel is closed when ctx is done.
+type Watcher interface {
+	Watch(ctx context.Context, prefix []byte) (<-chan Event, error)
+}
+
+// WatchBuffer is the number of events buffered for each subscriber.
+// Events for subscribers with a full buffer are dropped.
+var WatchBuffer = 128
+
+// Hub distributes events to subscribers. The zero value is ready to use.
+type Hub struct {
+	lock sync.RWMutex
+	subs map[*subscription]struct{}
+}
+
+type subscription struct {
+	match func(key []byte) bool
+	ch    chan Event
+}
+
+func (h *Hub) Subscribe(ctx context.Context, prefix []byte) (<-chan Event, error) {
+	// The matcher outlives the call, so it must not share memory with the caller
+	p := make([]byte, len(prefix))
+	copy(p, prefix)
+
+	match, err := Matcher(p)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &subscription{match, make(chan Event, WatchBuffer)}
+
+	h.lock.Lock()
+	if h.subs == nil {
+		h.subs = make(map[*subscription]struct{})
+	}
+	h.subs[s] = struct{}{}
+	h.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		h.lock.Lock()
+		delete(h.subs, s)
+		close(s.ch)
+		h.lock.Unlock()
+	}()
+
+	return s.ch, nil
+}
+
+// Publish sends an event to all matching subscribers without blocking.
+func (h *Hub) Publish(typ EventType, key []byte) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	if len(h.subs) == 0 {
+		return
+	}
+
+	k := make([]byte, len(key))
+	copy(k, key)
+	event := Event{typ, k}
+
+	for s := range h.subs {
+		if !s.match(k) {
+			continue
+		}
+		select {
+		case s.ch <- event:
+		default:
+			zap.L().Sugar().Warnf("Dropping %s event for %s, subscriber is too slow", typ, k)
+		}
+	}
+}
+
+// Len returns the number of subscribers.
+func (h *Hub) Len() int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.subs)
+}